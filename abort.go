@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/as/log"
+)
+
+// Upload is an incomplete multipart upload
+type Upload struct {
+	*url.URL
+	ID        string
+	Initiated time.Time
+}
+
+// inflight is an upload started by this process that must be
+// aborted if the process is interrupted. A nil abort means the
+// upload is deliberately kept (see -resume).
+type inflight struct {
+	dst   string
+	abort func() error
+}
+
+var uploads = sync.Map{}
+
+func track(dst string, abort func() error) *inflight {
+	up := &inflight{dst: dst, abort: abort}
+	uploads.Store(up, true)
+	return up
+}
+
+func (up *inflight) untrack() {
+	uploads.Delete(up)
+}
+
+// abortUploads aborts every multipart upload in flight; it is called
+// before exiting on a signal or fatal error so that incomplete parts
+// dont linger in the bucket
+func abortUploads() {
+	var wg sync.WaitGroup
+	uploads.Range(func(key, value interface{}) bool {
+		up, _ := key.(*inflight)
+		if up == nil {
+			return true
+		}
+		if up.abort == nil {
+			log.Info.Add("dst", up.dst).Printf("upload kept for -resume")
+			return true
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer up.untrack() // once is enough
+			line := log.Info.Add("action", "abort", "dst", up.dst)
+			if err := up.abort(); err != nil {
+				line.Error().Add("err", err).Printf("failed to abort multipart upload")
+				return
+			}
+			line.Printf("aborted multipart upload")
+		}()
+		return true
+	})
+	wg.Wait()
+}
+
+// trap is deferred by main and the goroutines that copy: if they
+// exit with log.Fatal, the uploads in flight are aborted and the
+// temporary files removed first
+func trap() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	abortUploads()
+	cleanup()
+	defer log.Trap() // exits for log.Fatal, panics otherwise
+	panic(v)
+}
+
+// doabortstale lists incomplete multipart uploads under each prefix
+// and aborts the ones older than age
+func doabortstale(age time.Duration, src ...string) {
+	type S interface {
+		Uploads(prefix string) ([]Upload, error)
+		Abort(Upload) error
+	}
+	var fatal error
+	for _, src := range src {
+		sfs, _ := driver[uri(src).Scheme].(S)
+		if sfs == nil {
+			log.Fatal.F("abort: scheme does not support multipart uploads: %s", src)
+		}
+		list, err := sfs.Uploads(src)
+		if err != nil {
+			log.Error.F("list uploads error: %q: %v", src, err)
+			fatal = err
+			continue
+		}
+		for _, up := range list {
+			if time.Since(up.Initiated) < age {
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\n", up.Initiated.Format(time.RFC3339), up.ID, up.URL)
+			if *dry {
+				continue
+			}
+			if err := sfs.Abort(up); err != nil {
+				log.Error.F("abort error: %q: %s: %v", up.URL, up.ID, err)
+				fatal = err
+				continue
+			}
+			loadState(up.URL.String()).done()
+		}
+	}
+	if fatal != nil {
+		log.Fatal.Add("err", fatal).Printf("")
+	}
+}
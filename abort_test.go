@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAbortUploadsOnce(t *testing.T) {
+	n := 0
+	up := track("s3://b/k", func() error { n++; return nil })
+	defer up.untrack()
+	kept := track("s3://b/kept", nil) // -resume
+	defer kept.untrack()
+	abortUploads()
+	abortUploads()
+	if n != 1 {
+		t.Fatalf("aborted %d times, want 1", n)
+	}
+}
+
+// stalefs is a bucket with incomplete multipart uploads
+type stalefs struct {
+	OS
+	list    []Upload
+	aborted []string
+}
+
+func (s *stalefs) Uploads(string) ([]Upload, error) { return s.list, nil }
+func (s *stalefs) Abort(up Upload) error {
+	s.aborted = append(s.aborted, up.ID)
+	return nil
+}
+
+func TestAbortStale(t *testing.T) {
+	u, _ := url.Parse("s3://b/k")
+	fs := &stalefs{list: []Upload{
+		{URL: u, ID: "old", Initiated: time.Now().Add(-48 * time.Hour)},
+		{URL: u, ID: "new", Initiated: time.Now()},
+	}}
+	s3 := driver["s3"]
+	driver["s3"] = fs
+	defer func() { driver["s3"] = s3 }()
+	defer func(d bool, sd string) { *dry, *statedir = d, sd }(*dry, *statedir)
+	*statedir = t.TempDir()
+
+	*dry = true
+	doabortstale(24*time.Hour, "s3://b/")
+	if len(fs.aborted) != 0 {
+		t.Fatalf("-dry aborted %v", fs.aborted)
+	}
+	*dry = false
+	doabortstale(24*time.Hour, "s3://b/")
+	if len(fs.aborted) != 1 || fs.aborted[0] != "old" {
+		t.Fatalf("aborted %v, want the old upload only", fs.aborted)
+	}
+}
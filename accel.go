@@ -16,7 +16,7 @@ import (
 	s3 "github.com/aws/aws-sdk-go/service/s3"
 )
 
-var sema chan bool
+var sema *aimd // see -maxhttp
 
 func sslstrip(su string, err error) (string, error) {
 	if err != nil {
@@ -68,6 +68,17 @@ type File struct {
 	Len   int
 	BS, R int
 	Block []Store
+	src   *mirrorset
+	race  []*race
+	next  int64 // the block the reader is on
+
+	nohedge int32          // a hedge was throttled (see hedgeBlock)
+	wg      sync.WaitGroup // the workers, hedges and their monitor
+}
+
+// wants returns whether the reader waits for the block
+func (f *File) wants(block int) func() bool {
+	return func() bool { return atomic.LoadInt64(&f.next) == int64(block) }
 }
 
 type Store interface {
@@ -119,7 +130,8 @@ func calcpartsize(size, hint int) (ps int) {
 }
 
 func (f *File) Download(dir string) error {
-	f.Len, _ = httpsize(dir)
+	f.src = newMirrorset(dir)
+	f.Len, _ = f.src.size()
 	if f.Len == 0 {
 		return fmt.Errorf("unknown file size")
 	}
@@ -142,32 +154,26 @@ func (f *File) Download(dir string) error {
 	f.Block = make([]Store, nw)
 
 	for i := range f.Block {
-		if i == 0 && partsize <= *maxmem {
-			f.Block[i] = &Block{}
-			log.Debug.Add().Printf("creating memory block")
-			// the first block might be in memory
-		} else {
-			if i == 0 {
-				// unless its too big
-				log.Debug.Add().Printf("partsize %d too large for memory block (maxmem=%d)", partsize, *maxmem)
-			}
-			// but the rest will always use the disk
-			s, err := makedisk(i)
-			log.Debug.Add().Printf("creating disk blocks")
-			if err != nil {
-				return err
-			}
-			f.Block[i] = s
-		}
+		// blocks use memory while the -maxmem budget allows
+		// and the disk otherwise
+		f.Block[i] = newstore(i, f.BS, f.wants(i))
+	}
+	f.race = make([]*race, nw)
+	for i := range f.race {
+		f.race[i] = &race{}
 	}
+	f.wg.Add(nw + 1)
 	for i := 0; i < nw; i++ {
 		i := i
-		go f.work(dir, i)
+		go f.work(i)
 	}
+	go f.hedgeMonitor()
 	return nil
 }
 
-func (f *File) work(dir string, block int) {
+func (f *File) work(block int) {
+	defer f.wg.Done()
+	defer trap()
 	doinit := func() {
 		err := f.Block[block].Init()
 		if err != nil {
@@ -177,7 +183,8 @@ func (f *File) work(dir string, block int) {
 	defer func() {
 		f.Block[block].Fin()
 	}()
-	r, _ := newHTTPRequest("GET", dir, nil)
+	r := f.race[block]
+	defer r.over()
 	sp := *seek + block*f.BS
 	log.Debug.Printf("sp=%d seek=%d count=%d", sp, *seek, *count)
 	count := *count
@@ -208,47 +215,112 @@ func (f *File) work(dir string, block int) {
 		if !*nosort {
 			time.Sleep(200 * time.Millisecond * time.Duration(block))
 		}
-		sema <- true
-		defer func() {
-			<-sema
-		}()
+		// a block waits for its storage before it takes a
+		// connection, or the one the reader needs may not get any
+		if p, ok := f.Block[block].(placer); ok {
+			if err := p.place(); err != nil {
+				log.Fatal.Add("err", err).F("placing block %d (tmp storage or permission issue): %v", block, err)
+			}
+		}
+		sema.acquire()
+		defer sema.release()
 	}
 	log.Debug.F("download block %d: start range %s", block, fmt.Sprintf("bytes=%d-%d", sp, ep-1))
-	r.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", sp, ep-1))
 
-	attempt := 0
-Retry:
-	resp, err := http.DefaultClient.Do(r.Clone(context.Background()))
-	if *debug {
-		logopen("fastopen", dir, resp, err)
+	// A failed attempt resumes from the last byte written,
+	// possibly on another mirror. A straggler may also be
+	// cancelled by its hedge (see race).
+	init, written := false, 0
+	initonce := func() {
+		if !init {
+			init = true
+			doinit()
+		}
+	}
+	ctx := r.begin(sp, ep)
+	for attempt, throttles := 0, 0; ; {
+		m := f.src.pick(block + attempt + throttles)
+		n, err := f.fetch(ctx, m, block, sp+written, ep, initonce)
+		written += int(n)
+		log.Debug.F("block %d: read %d bytes", block, n)
+		if err == nil && written < clamp {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if _, ok := isThrottle(err); ok {
+			// the server is alive, so this is not a failed attempt;
+			// the deadband catches a server that never recovers
+			throttles++
+			log.Warn.Add("err", err, "url", m.url).F("downloading block %d (throttled %d times)", block, throttles)
+			time.Sleep(backoff(throttles, err))
+			continue
+		}
+		if attempt++; attempt > *maxretry {
+			log.Fatal.Add("err", err).F("downloading block %d copied %d bytes before error", block, written)
+		}
+		log.Error.Add("err", err, "url", m.url).F("downloading block %d (attempt %d/%d)", block, attempt, *maxretry)
+		time.Sleep(backoff(attempt, err))
 	}
-	if attempt >= *maxretry && err != nil {
-		log.Fatal.Add("err", err).F("downloading block %d", block)
-	} else if err != nil {
-		attempt++
-		log.Error.Add("err", err).F("downloading block %d (attempt %d/%d)", block, attempt, *maxretry)
-		time.Sleep(time.Duration(attempt) * time.Second)
-		goto Retry
+	if r.finish() {
+		initonce()
+		n, err := r.splice(f.Block[block], int64(written))
+		log.Debug.F("block %d: spliced %d hedged bytes", block, n)
+		if err != nil {
+			log.Fatal.Add("err", err).F("splicing hedged block %d", block)
+		}
 	}
+}
 
-	body := io.Reader(resp.Body)
-	if clamp > 0 {
-		log.Debug.F("block %d: limiting read to %d bytes", block, clamp)
-		body = io.LimitReader(body, int64(clamp))
+// fetch copies the byte range [sp, ep) from m into the block,
+// calling doinit once the response arrives
+func (f *File) fetch(ctx context.Context, m *mirror, block, sp, ep int, doinit func()) (n int64, err error) {
+	start := time.Now()
+	defer func() {
+		if ctx.Err() == nil {
+			f.src.report(m, n, time.Since(start), err)
+		}
+	}()
+	r, err := newHTTPRequest("GET", m.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", sp, ep-1))
+	resp, err := http.DefaultClient.Do(r)
+	if *debug {
+		logopen("fastopen", m.url, resp, err)
 	}
-	doinit()
-	n, err := io.Copy(f.Block[block], body)
-	log.Debug.F("block %d: read %d bytes", block, n)
 	if err != nil {
-		log.Fatal.Add("err", err).F("downloading block %d copied %d bytes before error", block, n)
+		return 0, err
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
+	if err := throttled(resp); err != nil {
+		after, _ := isThrottle(err)
+		sema.throttle(after)
+		return 0, err
+	}
+	sema.ok()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && sp == 0 && ep == f.Len:
+	default:
+		return 0, fmt.Errorf("http: range %d-%d: %s", sp, ep-1, resp.Status)
+	}
+	doinit()
+	body := rxlimit(io.LimitReader(resp.Body, int64(ep-sp)), m.url)
+	return io.Copy(io.MultiWriter(f.Block[block], f.race[block]), body)
 }
 
 func (f *File) Close() (err error) {
 	return
 }
 
+// limited tells rxlimit that the blocks are rate limited as they are
+// downloaded, so reading the file is not limited again
+func (f *File) limited() {}
+
 func (f *File) Read(p []byte) (n int, err error) {
 	block := f.R / f.BS
 	seek := f.R % f.BS
@@ -276,6 +348,7 @@ func (f *File) Read(p []byte) (n int, err error) {
 		// advances past this block, we can dispose of it
 		// to free memory or disk space since nothing will
 		// read it again
+		atomic.StoreInt64(&f.next, int64(next))
 		f.Block[block].Close()
 	}
 	return
@@ -284,9 +357,10 @@ func (f *File) Read(p []byte) (n int, err error) {
 // Block is memory backed data
 type Block struct {
 	sync.Mutex
-	Data  []byte
-	fin   bool
-	ready int64
+	Data   []byte
+	fin    bool
+	ready  int64
+	budget int // bytes reserved from the memory budget
 }
 
 func (b *Block) Init() (err error) {
@@ -311,6 +385,13 @@ func (b *Block) Fin() {
 
 func (b *Block) Close() error {
 	log.Debug.F("closing memory block")
+	b.Lock()
+	defer b.Unlock()
+	if b.budget != 0 {
+		putbuf(b.Data)
+		release(b.budget)
+		b.budget = 0
+	}
 	b.Data = nil
 	return nil
 }
@@ -337,12 +418,21 @@ func (b *Block) ReadAt(p []byte, off int64) (n int, err error) {
 
 var tmpctr int64
 
-func makedisk(n int) (*Disk, error) {
-	tmp := temps[atomic.AddInt64(&tmpctr, +1)%int64(len(temps))]
-	log.Debug.Add().Printf("makedisk: %d: selected temp folder: %s", n, tmp)
+// makedisk returns a disk block of up to size bytes. The temporary
+// file is placed and preallocated when the block is initialized.
+func makedisk(n, size int) (*Disk, error) {
 	d := &Disk{}
 	d.init = func() error {
-		fd, err := os.CreateTemp(tmp, fmt.Sprintf("ccp%s-%04d", "*", n))
+		tmpmu.Lock()
+		defer tmpmu.Unlock()
+		// the first disk block makes room for the others
+		gconce.Do(func() { gctemps(temps...) })
+		tmp, err := placetemp(n, size)
+		if err != nil {
+			return err
+		}
+		log.Debug.Add().Printf("makedisk: %d: selected temp folder: %s", n, tmp)
+		fd, err := os.CreateTemp(tmp, tempfile(n))
 		if err != nil {
 			log.Error.Add().Printf("block %d: failed to create temp file in: %s: %s", n, tmp, err)
 			return err
@@ -351,6 +441,16 @@ func makedisk(n int) (*Disk, error) {
 		d.File = fd
 		log.Debug.F("created temp file %s", fd.Name())
 		tmpdir.Store(fd.Name(), true)
+		if err = locktemp(fd); err != nil {
+			log.Warn.Add("file", fd.Name(), "err", err).Printf("block %d: failed to lock temp file", n)
+		}
+		if err = preallocate(fd, size); err != nil {
+			log.Warn.Add("file", fd.Name(), "err", err).Printf("block %d: failed to preallocate %d bytes", n, size)
+		}
+		if *tmpcrypt {
+			d.crypt, err = newBlockcrypt()
+			return err
+		}
 		return nil
 	}
 	return d, nil
@@ -363,6 +463,12 @@ type Disk struct {
 	*os.File
 	fin   int64 // if 0, still writing otherwise done
 	ready int64
+
+	// crypt encrypts the file (see -tmpcrypt); w is the write
+	// offset and buf holds the ciphertext of the current write
+	crypt *blockcrypt
+	w     int64
+	buf   []byte
 }
 
 func (d *Disk) Ready() bool {
@@ -371,8 +477,15 @@ func (d *Disk) Ready() bool {
 
 func (d *Disk) Init() (err error) {
 	defer atomic.AddInt64(&d.ready, +1)
-	err = d.init()
-	if err != nil {
+	return d.place()
+}
+
+// place creates the temporary file, unless it was already
+func (d *Disk) place() error {
+	if d.File != nil {
+		return nil
+	}
+	if err := d.init(); err != nil {
 		return fmt.Errorf("disk init: %w", err)
 	}
 	return nil
@@ -385,6 +498,9 @@ func (d *Disk) ReadAt(p []byte, off int64) (n int, err error) {
 	retry := 10
 Read:
 	n, err = d.File.ReadAt(p, off)
+	if d.crypt != nil {
+		d.crypt.xor(p[:n], p[:n], off)
+	}
 	if n == 0 && err == nil {
 		quantum() // avoid spinning in a read loop
 	}
@@ -406,6 +522,20 @@ Read:
 	return
 }
 
+func (d *Disk) Write(p []byte) (n int, err error) {
+	if d.crypt == nil {
+		return d.File.Write(p)
+	}
+	if cap(d.buf) < len(p) {
+		d.buf = make([]byte, len(p))
+	}
+	buf := d.buf[:len(p)]
+	d.crypt.xor(buf, p, d.w)
+	n, err = d.File.Write(buf)
+	d.w += int64(n)
+	return n, err
+}
+
 func (d *Disk) Fin() {
 	atomic.AddInt64(&d.fin, +1)
 }
@@ -420,6 +550,7 @@ func (d *Disk) Close() error {
 		os.Remove(d.Name)
 		tmpdir.Delete(d.Name)
 		log.Debug.F("delete file %q", d.Name)
+		freed()
 	}
 	return err
 }
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/as/log"
+)
+
+// sig is what a listing says about a file; a file whose sig is the
+// one in the baseline has not changed since the last run
+type sig struct {
+	size  int
+	mtime int64
+}
+
+func sigof(f Info) sig {
+	return sig{size: f.Size, mtime: f.ModTime.UnixNano()}
+}
+
+// pair is a baseline entry: how both sides looked after the last run
+type pair struct{ a, b sig }
+
+// the state of a file on one side, since the last run
+const (
+	stNone    = iota // not there, and was not
+	stSame           // unchanged
+	stChanged        // modified
+	stNew            // created
+	stGone           // deleted
+)
+
+func state(f Info, ok bool, base sig, inbase bool) int {
+	switch {
+	case ok && inbase && sigof(f) == base:
+		return stSame
+	case ok && inbase:
+		return stChanged
+	case ok:
+		return stNew
+	case inbase:
+		return stGone
+	}
+	return stNone
+}
+
+// decision is what two-way sync does with a file
+type decision struct {
+	rel string
+	op  string // a->b, b->a, delete a, delete b, conflict or keep both
+	why string
+	// keep is the name the older version is kept under
+	keep string
+	// the state on either side
+	sa, sb int
+}
+
+var statenames = []string{"absent", "unchanged", "changed", "new", "deleted"}
+
+// bisyncplan compares both sides (by path under their roots) with the
+// baseline. Files new or changed on both sides are conflicts, unless
+// identical says they are the same.
+func bisyncplan(a, b map[string]Info, base map[string]pair, identical func(a, b Info) bool) (plan []decision) {
+	names := map[string]bool{}
+	for _, m := range []map[string]Info{a, b} {
+		for rel := range m {
+			names[rel] = true
+		}
+	}
+	for rel := range base {
+		names[rel] = true
+	}
+	for rel := range names {
+		fa, oka := a[rel]
+		fb, okb := b[rel]
+		p, inbase := base[rel]
+		d := decision{rel: rel, sa: state(fa, oka, p.a, inbase), sb: state(fb, okb, p.b, inbase)}
+		d.why = "a " + statenames[d.sa] + ", b " + statenames[d.sb]
+		touched := func(s int) bool { return s == stChanged || s == stNew }
+		switch {
+		case touched(d.sa) && (d.sb == stSame || d.sb == stNone):
+			d.op = "a->b"
+		case touched(d.sb) && (d.sa == stSame || d.sa == stNone):
+			d.op = "b->a"
+		case d.sa == stGone && d.sb == stSame:
+			d.op = "delete b"
+		case d.sb == stGone && d.sa == stSame:
+			d.op = "delete a"
+		case touched(d.sa) && touched(d.sb):
+			if identical(fa, fb) {
+				continue
+			}
+			d.op = "conflict"
+		case touched(d.sa) || touched(d.sb):
+			// changed on one side, deleted on the other
+			d.op = "conflict"
+		default:
+			continue
+		}
+		plan = append(plan, d)
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].rel < plan[j].rel })
+	return plan
+}
+
+// resolve applies the -conflict policy to a conflict. A file changed
+// on one side and deleted on the other is kept by newer and both.
+func resolve(d decision, a, b string) decision {
+	if d.op != "conflict" {
+		return d
+	}
+	switch {
+	case *conflict == "fail":
+		return d
+	case d.sa == stGone:
+		d.op, d.why = "b->a", d.why+"; kept the change"
+		return d
+	case d.sb == stGone:
+		d.op, d.why = "a->b", d.why+"; kept the change"
+		return d
+	}
+	ta, erra := statattr(join(a, d.rel))
+	tb, errb := statattr(join(b, d.rel))
+	if erra != nil || errb != nil {
+		d.why += "; no modification times"
+		return d
+	}
+	newer, older := "a", tb.ModTime
+	d.op = "a->b"
+	if tb.ModTime.After(ta.ModTime) {
+		newer, older = "b", ta.ModTime
+		d.op = "b->a"
+	}
+	d.why += "; " + newer + " is newer"
+	if *conflict == "both" {
+		d.keep = conflictname(d.rel, older)
+		d.why += ", the other is kept as " + d.keep
+		d.op = "keep both " + d.op
+	}
+	return d
+}
+
+// conflictname is the name the version of rel modified at t is kept
+// under
+func conflictname(rel string, t time.Time) string {
+	ext := path.Ext(rel)
+	return strings.TrimSuffix(rel, ext) + ".conflict-" + t.UTC().Format("20060102T150405") + ext
+}
+
+// join returns the file rel under root
+func join(root, rel string) string {
+	u := uri(root)
+	u.Path = path.Join(u.Path, rel)
+	if localscheme(u.Scheme) {
+		return localize(u.Path)
+	}
+	return u.String()
+}
+
+// listside lists the files under root by their path under it
+func listside(root string) map[string]Info {
+	m, err := listrel(root)
+	if err != nil {
+		log.Fatal.Add("action", "list", "dir", root, "err", err).Printf("list error")
+	}
+	return m
+}
+
+// listrel lists the files under root that the filters select, by
+// their path under it
+func listrel(root string) (map[string]Info, error) {
+	list, err := listtree(root)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]Info{}
+	for _, f := range list {
+		// join(root, rel) has to be f again
+		if rel, ok := inside(uri(root).Path, f.Path); ok && keep(root, f) {
+			m[rel] = f
+		}
+	}
+	return m, nil
+}
+
+// listone returns file as listings have it, so its sig is the one the
+// next run sees
+func listone(file string) (Info, error) {
+	list, err := driver[uri(file).Scheme].List(file)
+	if err != nil {
+		return Info{}, err
+	}
+	u := uri(file)
+	for _, f := range list {
+		if treekey(f.URL) == treekey(&u) {
+			return f, nil
+		}
+	}
+	return Info{}, fmt.Errorf("%s: %w", file, os.ErrNotExist)
+}
+
+// baselinefile returns -baseline, or a file for the pair of roots in
+// the user's cache directory
+func baselinefile(a, b string) string {
+	if *baseline != "" {
+		return *baseline
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	for _, root := range []*string{&a, &b} {
+		if localscheme(uri(*root).Scheme) {
+			*root, _ = filepath.Abs(localize(*root))
+		}
+	}
+	h := sha256.Sum256([]byte(a + "\n" + b))
+	return filepath.Join(dir, "ccp", "bisync", hex.EncodeToString(h[:8])+".tsv")
+}
+
+// readBaseline reads a baseline; a missing one is empty (the first run)
+func readBaseline(file string) (map[string]pair, error) {
+	base := map[string]pair{}
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return base, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	sc := bufio.NewScanner(fd)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Split(sc.Text(), "\t")
+		v := make([]int64, 4)
+		for i := 1; len(f) == 5 && i < 5; i++ {
+			v[i-1], err = strconv.ParseInt(f[i], 10, 64)
+		}
+		rel, qerr := strconv.Unquote(f[0])
+		if len(f) != 5 || err != nil || qerr != nil {
+			return nil, fmt.Errorf("baseline: %s:%d: bad line", file, n)
+		}
+		base[rel] = pair{a: sig{int(v[0]), v[1]}, b: sig{int(v[2]), v[3]}}
+	}
+	return base, sc.Err()
+}
+
+func writeBaseline(file string, base map[string]pair) error {
+	os.MkdirAll(filepath.Dir(file), 0777)
+	tmp := file + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	names := []string{}
+	for rel := range base {
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	for _, rel := range names {
+		p := base[rel]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", strconv.Quote(rel), p.a.size, p.a.mtime, p.b.size, p.b.mtime)
+	}
+	if err = w.Flush(); err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// dobisync syncs the trees a and b both ways: files created, changed
+// or deleted on one side since the last run are created, changed or
+// deleted on the other. Every decision is printed as tab separated
+// operation, path and reason.
+func dobisync(a, b string) {
+	for _, root := range []string{a, b} {
+		if driver[uri(root).Scheme] == nil || root == "-" || hasglob(root) {
+			log.Fatal.F("bisync: not a directory: %s", root)
+		}
+	}
+	file := baselinefile(a, b)
+	base, err := readBaseline(file)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	la, lb := listside(a), listside(b)
+	for side, l := range map[string]map[string]Info{a: la, b: lb} {
+		if len(l) == 0 && len(base) > 0 {
+			// more likely a mistake than a deletion of everything
+			log.Fatal.F("bisync: %s is empty but was not, remove %s to start over", side, file)
+		}
+	}
+	plan := bisyncplan(la, lb, base, func(fa, fb Info) bool { return differ(fa, fb) == "" })
+	log.Info.Add("action", "bisync", "a", a, "b", b, "baseline", file, "first", len(base) == 0, "changes", len(plan)).Printf("bisync plan")
+
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	done := make([]chan error, len(plan))
+	for i := range plan {
+		i, d := i, resolve(plan[i], a, b)
+		plan[i] = d
+		done[i] = make(chan error, 1)
+		if *dry || d.op == "conflict" {
+			done[i] <- nil
+			continue
+		}
+		q.add(func() { done[i] <- apply(d, a, b) }, join(a, d.rel), join(b, d.rel))
+	}
+	q.run()
+
+	failed := map[string]bool{}
+	for i, d := range plan {
+		status := ""
+		if err := <-done[i]; err != nil {
+			status = "\tfailed: " + err.Error()
+			failed[d.rel] = true
+			nerr++
+		} else if d.op == "conflict" {
+			status = "\tunresolved (see -conflict)"
+			failed[d.rel] = true
+			nerr++
+		}
+		fmt.Printf("%s\t%s\t%s%s\n", d.op, d.rel, d.why, status)
+	}
+	if *dry {
+		return
+	}
+
+	// the next baseline is what the plan was made from, and what was
+	// written. Listing both sides again would take files edited
+	// during the run for unchanged ones.
+	next := map[string]pair{}
+	for rel, fa := range la {
+		if fb, ok := lb[rel]; ok {
+			next[rel] = pair{a: sigof(fa), b: sigof(fb)}
+		}
+	}
+	for _, d := range plan {
+		delete(next, d.rel)
+		if failed[d.rel] || strings.HasPrefix(d.op, "delete") {
+			continue
+		}
+		if d.keep != "" {
+			fa, erra := listone(join(a, d.keep))
+			fb, errb := listone(join(b, d.keep))
+			if erra == nil && errb == nil {
+				next[d.keep] = pair{a: sigof(fa), b: sigof(fb)}
+			}
+		}
+		// the source is as planned, the copy as written
+		if strings.HasSuffix(d.op, "a->b") {
+			if fb, err := listone(join(b, d.rel)); err == nil {
+				next[d.rel] = pair{a: sigof(la[d.rel]), b: sigof(fb)}
+			}
+		} else if fa, err := listone(join(a, d.rel)); err == nil {
+			next[d.rel] = pair{a: sigof(fa), b: sigof(lb[d.rel])}
+		}
+	}
+	for rel := range failed {
+		if p, ok := base[rel]; ok {
+			next[rel] = p
+		}
+	}
+	if err := writeBaseline(file, next); err != nil {
+		log.Error.Add("action", "bisync", "baseline", file, "err", err).Printf("baseline not saved")
+		nerr++
+	}
+}
+
+// apply carries out a decision
+func apply(d decision, a, b string) error {
+	from, to := join(a, d.rel), join(b, d.rel)
+	if strings.HasSuffix(d.op, "b->a") {
+		from, to = to, from
+	}
+	switch {
+	case d.op == "delete a":
+		return driver[uri(from).Scheme].Delete(from)
+	case d.op == "delete b":
+		return driver[uri(to).Scheme].Delete(to)
+	case strings.HasPrefix(d.op, "keep both"):
+		// the older version gets a name of its own on both sides
+		if err := cp(to, join(a, d.keep)); err != nil {
+			return err
+		}
+		if err := cp(to, join(b, d.keep)); err != nil {
+			return err
+		}
+	}
+	return cp(from, to)
+}
+
+// cp copies src to dst
+func cp(src, dst string) error {
+	c := make(chan work, 1)
+	docp(src, dst, c, nil)
+	return (<-c).err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBisyncPlan(t *testing.T) {
+	t0 := time.Unix(1e9, 0)
+	f := func(size int, age int) Info {
+		return Info{URL: &url.URL{}, Size: size, ModTime: t0.Add(time.Duration(age) * time.Second)}
+	}
+	s := func(size int, age int) sig { return sigof(f(size, age)) }
+	a := map[string]Info{
+		"same": f(1, 0), "newa": f(1, 0), "changeda": f(2, 1), "both": f(3, 1),
+		"bothsame": f(4, 1), "moddel": f(5, 1), "newboth": f(6, 0),
+	}
+	b := map[string]Info{
+		"same": f(1, 0), "newb": f(1, 0), "changeda": f(1, 0), "gonea": f(1, 0), "both": f(3, 2),
+		"bothsame": f(4, 2), "newboth": f(7, 0),
+	}
+	base := map[string]pair{
+		"same": {s(1, 0), s(1, 0)}, "changeda": {s(1, 0), s(1, 0)}, "gonea": {s(1, 0), s(1, 0)},
+		"both": {s(3, 0), s(3, 0)}, "bothsame": {s(4, 0), s(4, 0)}, "moddel": {s(5, 0), s(5, 0)},
+		"gone": {s(1, 0), s(1, 0)},
+	}
+	identical := func(a, b Info) bool { return a.Size == 4 }
+	have := map[string]string{}
+	for _, d := range bisyncplan(a, b, base, identical) {
+		have[d.rel] = d.op
+	}
+	want := map[string]string{
+		"newa": "a->b", "newb": "b->a", "changeda": "a->b", "gonea": "delete b",
+		"both": "conflict", "moddel": "conflict", "newboth": "conflict",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("plan:\nhave %v\nwant %v", have, want)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dir", "base.tsv")
+	base := map[string]pair{"a\tb.txt": {sig{1, 2}, sig{3, 4}}, "c/d": {sig{5, -6}, sig{7, 8}}}
+	if err := writeBaseline(file, base); err != nil {
+		t.Fatal(err)
+	}
+	have, err := readBaseline(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, base) {
+		t.Fatalf("have %v want %v", have, base)
+	}
+	if have, err := readBaseline(file + ".missing"); err != nil || len(have) != 0 {
+		t.Fatalf("missing baseline: %v %v", have, err)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	if have := conflictname("d/x.tar.gz", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)); have != "d/x.tar.conflict-20240102T030405.gz" {
+		t.Fatalf("have %q", have)
+	}
+}
+
+func TestListRelSiblings(t *testing.T) {
+	withbucket(t, prefixfs{"dir/x", "dir/sub/y", "dir2/x", "dirt"})
+	m, err := listrel("s3://b/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := []string{}
+	for rel, f := range m {
+		if join("s3://b/dir", rel) != f.String() {
+			t.Errorf("%s: joins to %s", f, join("s3://b/dir", rel))
+		}
+		have = append(have, rel)
+	}
+	sort.Strings(have)
+	if want := []string{"sub/y", "x"}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("have %q want %q", have, want)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/as/log"
+)
+
+// tmpkey is the key for encrypted disk blocks (see -tmpcrypt). It is
+// random for every process and only ever lives in memory, so blocks
+// left on disk by a crash or -nogc can not be read back.
+var tmpkey struct {
+	sync.Once
+	cipher.Block
+}
+
+// blockcrypt encrypts a disk block with aes in counter mode. Every block
+// has its own random iv, and the keystream is addressed by the byte
+// offset so ReadAt can decrypt anywhere in the block.
+type blockcrypt struct {
+	b  cipher.Block
+	iv [aes.BlockSize]byte
+}
+
+func newBlockcrypt() (*blockcrypt, error) {
+	tmpkey.Do(func() {
+		key := make([]byte, 32)
+		if _, err := crand.Read(key); err != nil {
+			log.Fatal.F("tmpcrypt: generate key: %v", err)
+		}
+		tmpkey.Block, _ = aes.NewCipher(key)
+	})
+	c := &blockcrypt{b: tmpkey.Block}
+	_, err := crand.Read(c.iv[:])
+	return c, err
+}
+
+// xor applies the keystream at offset off of the block to src
+// and stores the result in dst
+func (c *blockcrypt) xor(dst, src []byte, off int64) {
+	ctr := c.iv
+	hi, lo := binary.BigEndian.Uint64(ctr[:8]), binary.BigEndian.Uint64(ctr[8:])
+	n := uint64(off / aes.BlockSize)
+	if lo+n < lo {
+		hi++
+	}
+	binary.BigEndian.PutUint64(ctr[:8], hi)
+	binary.BigEndian.PutUint64(ctr[8:], lo+n)
+	s := cipher.NewCTR(c.b, ctr[:])
+	if skip := off % aes.BlockSize; skip != 0 {
+		junk := make([]byte, skip)
+		s.XORKeyStream(junk, junk)
+	}
+	s.XORKeyStream(dst, src)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestBlockcrypt(t *testing.T) {
+	c, err := newBlockcrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.iv = [aes.BlockSize]byte{15: 0xfe, 14: 0xff, 13: 0xff, 12: 0xff, 11: 0xff, 10: 0xff, 9: 0xff, 8: 0xff}
+	plain := bytes.Repeat([]byte("0123456789abcdef-"), 100)
+	want := make([]byte, len(plain))
+	cipher.NewCTR(c.b, c.iv[:]).XORKeyStream(want, plain)
+
+	for _, off := range []int{0, 1, 15, 16, 17, 31, 32, 33, 500, len(plain) - 1} {
+		for _, n := range []int{1, 7, 16, 100} {
+			if off+n > len(plain) {
+				n = len(plain) - off
+			}
+			have := make([]byte, n)
+			c.xor(have, plain[off:off+n], int64(off))
+			if !bytes.Equal(have, want[off:off+n]) {
+				t.Fatalf("off=%d n=%d: keystream mismatch", off, n)
+			}
+			c.xor(have, have, int64(off))
+			if !bytes.Equal(have, plain[off:off+n]) {
+				t.Fatalf("off=%d n=%d: round trip mismatch", off, n)
+			}
+		}
+	}
+}
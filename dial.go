@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/as/log"
+)
+
+// spreader dials every address a host resolves to in turn, so new
+// connections (e.g., for the blocks of an accelerated download) are
+// spread across all the front-ends of a service instead of the first
+// one the resolver returns. The local side of each connection takes
+// turns among the -bind addresses.
+//
+// Each dial races the addresses happy-eyeballs style: the next one is
+// tried after -fallback, or as soon as the previous one fails, and
+// the first connection wins.
+type spreader struct {
+	net.Dialer
+	local []net.IP
+
+	mu    sync.Mutex
+	hosts map[string]*resolved
+	n     uint64 // local address counter
+}
+
+type resolved struct {
+	ip []net.IP
+	at time.Time
+	n  uint64
+}
+
+// resolvettl is how long the addresses of a host are cached
+const resolvettl = time.Minute
+
+var (
+	dialonce sync.Once
+	dialer   *spreader
+	dialerr  error
+)
+
+// getdialer returns the dialer shared by every transport
+func getdialer() (*spreader, error) {
+	dialonce.Do(func() {
+		dialer = &spreader{
+			Dialer: net.Dialer{Timeout: *dialtimeout, KeepAlive: *keepalive},
+			hosts:  map[string]*resolved{},
+		}
+		if *ipv4 && *ipv6 {
+			dialerr = fmt.Errorf("-4 and -6 are mutually exclusive")
+			return
+		}
+		dialer.local, dialerr = localaddrs(*bind)
+	})
+	return dialer, dialerr
+}
+
+// localaddrs parses a comma separated list of local ip addresses
+// and interface names
+func localaddrs(list string) (ip []net.IP, err error) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if a := net.ParseIP(name); a != nil {
+			ip = append(ip, a)
+			continue
+		}
+		ifc, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("bind: %w", err)
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("bind: %s: %w", name, err)
+		}
+		n := len(ip)
+		for _, a := range addrs {
+			if a, ok := a.(*net.IPNet); ok && !a.IP.IsLinkLocalUnicast() {
+				ip = append(ip, a.IP)
+			}
+		}
+		if len(ip) == n {
+			return nil, fmt.Errorf("bind: %s: no usable address", name)
+		}
+	}
+	return ip, nil
+}
+
+// family reports whether ip is allowed by -4 and -6
+func family(ip net.IP) bool {
+	v4 := ip.To4() != nil
+	return !(*ipv4 && !v4) && !(*ipv6 && v4)
+}
+
+// resolve returns the addresses of host, rotated by one for every
+// call, so consecutive connections start with different addresses
+func (d *spreader) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	d.mu.Lock()
+	r := d.hosts[host]
+	d.mu.Unlock()
+	if r == nil || time.Since(r.at) > resolvettl {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		r = &resolved{at: time.Now()}
+		for _, a := range addrs {
+			if family(a.IP) {
+				r.ip = append(r.ip, a.IP)
+			}
+		}
+		if len(r.ip) == 0 {
+			return nil, fmt.Errorf("dial: %s: no address of the requested family", host)
+		}
+		d.mu.Lock()
+		d.hosts[host] = r
+		d.mu.Unlock()
+	}
+	k := int(atomic.AddUint64(&r.n, 1)-1) % len(r.ip)
+	ip := append(append([]net.IP{}, r.ip[k:]...), r.ip[:k]...)
+	return interleave(ip), nil
+}
+
+// interleave alternates the address families, keeping the family of
+// the first address first (rfc 8305)
+func interleave(ip []net.IP) []net.IP {
+	var a, b []net.IP
+	for _, x := range ip {
+		if (x.To4() != nil) == (ip[0].To4() != nil) {
+			a = append(a, x)
+		} else {
+			b = append(b, x)
+		}
+	}
+	out := make([]net.IP, 0, len(ip))
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if i < len(a) {
+			out = append(out, a[i])
+		}
+		if i < len(b) {
+			out = append(out, b[i])
+		}
+	}
+	return out
+}
+
+func (d *spreader) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return d.race(ctx, network, ip, port)
+}
+
+// race dials ip in order, starting the next attempt after -fallback
+// or when an attempt fails, and returns the first connection
+func (d *spreader) race(ctx context.Context, network string, ip []net.IP, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ip))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	started, failed := 0, 0
+	var first error
+	for {
+		var next <-chan time.Time
+		if started < len(ip) {
+			next = timer.C
+		}
+		select {
+		case <-next:
+			go func(ip net.IP) {
+				c, err := d.dial1(ctx, network, ip, port)
+				results <- result{c, err}
+			}(ip[started])
+			started++
+			timer.Reset(*fallback)
+		case r := <-results:
+			if r.err == nil {
+				// close the connections that lose the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(started - failed - 1)
+				return r.c, nil
+			}
+			if first == nil {
+				first = r.err
+			}
+			if failed++; failed == len(ip) {
+				return nil, first
+			}
+			if started < len(ip) {
+				// try the next one now
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+func (d *spreader) dial1(ctx context.Context, network string, ip net.IP, port string) (net.Conn, error) {
+	nd := d.Dialer
+	if la := d.localfor(ip); la != nil {
+		nd.LocalAddr = &net.TCPAddr{IP: la}
+	}
+	addr := net.JoinHostPort(ip.String(), port)
+	c, err := nd.DialContext(ctx, network, addr)
+	line := log.Debug.Add("action", "dial", "network", network, "addr", addr)
+	if err != nil {
+		line.Add("err", err).Printf("connection failed")
+		return nil, err
+	}
+	line.Add("laddr", c.LocalAddr().String(), "raddr", c.RemoteAddr().String()).Printf("connected")
+	return c, nil
+}
+
+// localfor returns the next -bind address of the same family as ip
+func (d *spreader) localfor(ip net.IP) net.IP {
+	v4 := ip.To4() != nil
+	same := []net.IP{}
+	for _, la := range d.local {
+		if (la.To4() != nil) == v4 {
+			same = append(same, la)
+		}
+	}
+	if len(same) == 0 {
+		return nil
+	}
+	return same[int(atomic.AddUint64(&d.n, 1)-1)%len(same)]
+}
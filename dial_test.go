@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSpreaderResolve(t *testing.T) {
+	ips := func(s ...string) (ip []net.IP) {
+		for _, s := range s {
+			ip = append(ip, net.ParseIP(s))
+		}
+		return ip
+	}
+	d := &spreader{hosts: map[string]*resolved{
+		"example.com": {ip: ips("192.0.2.1", "192.0.2.2", "2001:db8::1"), at: time.Now()},
+	}}
+	for i, want := range [][]net.IP{
+		ips("192.0.2.1", "2001:db8::1", "192.0.2.2"),
+		ips("192.0.2.2", "2001:db8::1", "192.0.2.1"),
+		ips("2001:db8::1", "192.0.2.1", "192.0.2.2"),
+		ips("192.0.2.1", "2001:db8::1", "192.0.2.2"),
+	} {
+		have, err := d.resolve(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("%d: have %v want %v", i, have, want)
+		}
+		for j := range have {
+			if !have[j].Equal(want[j]) {
+				t.Fatalf("%d: have %v want %v", i, have, want)
+			}
+		}
+	}
+}
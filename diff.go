@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/as/log"
+)
+
+// delta is a file that is not the same in both trees of -diff
+type delta struct {
+	Kind string `json:"kind"` // only-a, only-b or differ
+	Path string `json:"path"`
+	A    *side  `json:"a,omitempty"`
+	B    *side  `json:"b,omitempty"`
+	Why  string `json:"why,omitempty"`
+}
+
+type side struct {
+	URL  string `json:"url"`
+	Size int    `json:"size"`
+}
+
+func sideof(f Info) *side {
+	return &side{URL: f.String(), Size: f.Size}
+}
+
+// String returns d in the tab separated format: kind, path, the sizes
+// in a and b (- if not there) and why they differ
+func (d delta) String() string {
+	size := func(s *side) string {
+		if s == nil {
+			return "-"
+		}
+		return fmt.Sprint(s.Size)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s", d.Kind, d.Path, size(d.A), size(d.B), d.Why)
+}
+
+// treediff compares the files in a and b, by their paths. Files in
+// both differ if their sizes do, or if differ (with -checksum) says
+// so.
+func treediff(a, b map[string]Info, differ func(a, b Info) string) (list []delta, same int, err error) {
+	names := []string{}
+	for rel := range a {
+		names = append(names, rel)
+	}
+	for rel := range b {
+		if _, ok := a[rel]; !ok {
+			names = append(names, rel)
+		}
+	}
+	sort.Strings(names)
+
+	// checksums take a while, so they are compared in parallel
+	why := make([]chan string, len(names))
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, rel := range names {
+		fa, oka := a[rel]
+		fb, okb := b[rel]
+		why[i] = make(chan string, 1)
+		switch {
+		case !oka || !okb:
+			why[i] <- ""
+		case fa.Size != fb.Size:
+			why[i] <- "size"
+		case differ == nil:
+			why[i] <- ""
+		default:
+			i := i
+			q.add(func() { why[i] <- differ(fa, fb) }, fa.String(), fb.String())
+		}
+	}
+	q.run()
+
+	for i, rel := range names {
+		fa, oka := a[rel]
+		fb, okb := b[rel]
+		d := delta{Path: rel, Why: <-why[i]}
+		switch {
+		case !okb:
+			d.Kind, d.A = "only-a", sideof(fa)
+		case !oka:
+			d.Kind, d.B = "only-b", sideof(fb)
+		case d.Why != "":
+			d.Kind, d.A, d.B = "differ", sideof(fa), sideof(fb)
+		default:
+			same++
+			continue
+		}
+		list = append(list, d)
+	}
+	return list, same, nil
+}
+
+// dodiff prints the files that are only in a, only in b, or differ,
+// and exits like diff: with 0 if the trees are the same, 1 if they
+// differ and 2 on errors
+func dodiff(a, b string) {
+	for _, root := range []string{a, b} {
+		if driver[uri(root).Scheme] == nil || root == "-" || hasglob(root) {
+			log.Error.F("diff: not a directory: %s", root)
+			os.Exit(2)
+		}
+	}
+	var (
+		la, lb     map[string]Info
+		erra, errb error
+		done       = make(chan bool)
+	)
+	go func() {
+		la, erra = listrel(a)
+		close(done)
+	}()
+	lb, errb = listrel(b)
+	<-done
+	for _, e := range []struct {
+		root string
+		err  error
+	}{{a, erra}, {b, errb}} {
+		if e.err != nil {
+			log.Error.Add("action", "list", "dir", e.root, "err", e.err).Printf("list error")
+			os.Exit(2)
+		}
+	}
+
+	var sumdiffer func(a, b Info) string
+	if *bysum {
+		sumdiffer = func(fa, fb Info) string {
+			same, err := samesum(fa.String(), fb.String())
+			if err != nil {
+				log.Error.Add("action", "diff", "a", fa.String(), "b", fb.String(), "err", err).Printf("checksum error")
+				return "error: " + err.Error()
+			}
+			if !same {
+				return "checksum"
+			}
+			return ""
+		}
+	}
+	list, same, err := treediff(la, lb, sumdiffer)
+	if err != nil {
+		log.Error.F("%v", err)
+		os.Exit(2)
+	}
+	for _, d := range list {
+		if *jsonout {
+			b, _ := json.Marshal(d)
+			fmt.Println(string(b))
+		} else {
+			fmt.Println(d)
+		}
+	}
+	n, failed := map[string]int{}, 0
+	for _, d := range list {
+		n[d.Kind]++
+		if strings.HasPrefix(d.Why, "error: ") {
+			failed++
+		}
+	}
+	log.Info.Add("action", "diff", "a", a, "b", b, "same", same, "only-a", n["only-a"], "only-b", n["only-b"], "differ", n["differ"]).Printf("diff")
+	switch {
+	case failed > 0:
+		os.Exit(2)
+	case len(list) > 0:
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
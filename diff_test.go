@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestTreeDiff(t *testing.T) {
+	f := func(size int) Info { return Info{URL: &url.URL{Path: "x"}, Size: size} }
+	a := map[string]Info{"same": f(1), "onlya": f(1), "size": f(1), "sum": f(2)}
+	b := map[string]Info{"same": f(1), "onlyb": f(1), "size": f(2), "sum": f(2)}
+	for _, tc := range []struct {
+		differ func(a, b Info) string
+		want   []string
+		same   int
+	}{
+		{nil, []string{"only-a onlya ", "only-b onlyb ", "differ size size"}, 2},
+		{func(a, b Info) string {
+			if a.Size == 2 {
+				return "checksum"
+			}
+			return ""
+		}, []string{"only-a onlya ", "only-b onlyb ", "differ size size", "differ sum checksum"}, 1},
+	} {
+		list, same, err := treediff(a, b, tc.differ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := []string{}
+		for _, d := range list {
+			have = append(have, d.Kind+" "+d.Path+" "+d.Why)
+		}
+		if !reflect.DeepEqual(have, tc.want) || same != tc.same {
+			t.Fatalf("have %q (%d same), want %q (%d same)", have, same, tc.want, tc.same)
+		}
+	}
+}
+
+func TestDeltaString(t *testing.T) {
+	d := delta{Kind: "only-b", Path: "a/b", B: &side{Size: 3}}
+	if have, want := d.String(), "only-b\ta/b\t-\t3\t"; have != want {
+		t.Fatalf("have %q, want %q", have, want)
+	}
+}
+
+func TestDiffSiblings(t *testing.T) {
+	withbucket(t, prefixfs{"p/a", "p/b", "p2/a", "pq"})
+	gs := driver["gs"]
+	driver["gs"] = prefixfs{"p/a", "p/b", "px/c"}
+	defer func() { driver["gs"] = gs }()
+
+	la, err := listrel("s3://b/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := listrel("gs://c/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, same, err := treediff(la, lb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 || same != 2 {
+		t.Fatalf("have %v (%d same), want 2 same", list, same)
+	}
+}
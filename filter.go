@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/as/log"
+)
+
+// globchars start the wildcard part of a source
+const globchars = "*?["
+
+// the compiled filters; see initfilter
+var (
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+	minsize  int64
+	maxsize  int64 = -1
+	newer    time.Time
+	older    time.Time
+)
+
+// globre returns a regular expression matching what the shell-style
+// glob does: * and ? do not match a slash, ** matches anything (and
+// **/ also nothing), and [...] is a class ([!...] negated)
+func globre(glob string) (*regexp.Regexp, error) {
+	re := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				re += "(.*/)?"
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				re += ".*"
+				i++
+			} else {
+				re += "[^/]*"
+			}
+		case '?':
+			re += "[^/]"
+		case '[':
+			n := strings.IndexByte(glob[i+1:], ']')
+			if n < 0 {
+				return nil, fmt.Errorf("glob: unclosed [: %q", glob)
+			}
+			class := glob[i+1 : i+1+n]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re += "[" + strings.ReplaceAll(class, `\`, `\\`) + "]"
+			i += n + 1
+		default:
+			re += regexp.QuoteMeta(string(c))
+		}
+	}
+	return regexp.Compile(re + "$")
+}
+
+// hasglob reports whether the path of src has wildcards
+func hasglob(src string) bool {
+	return strings.ContainsAny(uri(src).Path, globchars)
+}
+
+// globroot returns the directory of src before its wildcards, which
+// copies of the files it matches are relative to
+func globroot(src string) string {
+	if !hasglob(src) {
+		return src
+	}
+	u := uri(src)
+	u.Path = prefix(u.Path)
+	if u.Path == "" {
+		return "."
+	}
+	return strings.TrimSuffix(u.String(), "/") + "/"
+}
+
+// initfilter compiles -include, -exclude, -min-size, -max-size,
+// -newer-than and -older-than
+func initfilter() (err error) {
+	for _, g := range include {
+		re, err := namere(g)
+		if err != nil {
+			return fmt.Errorf("include: %w", err)
+		}
+		includes = append(includes, re)
+	}
+	for _, g := range exclude {
+		re, err := namere(g)
+		if err != nil {
+			return fmt.Errorf("exclude: %w", err)
+		}
+		excludes = append(excludes, re)
+	}
+	for _, v := range []struct {
+		flag string
+		list strlist
+		to   *[]*regexp.Regexp
+	}{{"include-re", includere, &includes}, {"exclude-re", excludere, &excludes}} {
+		for _, expr := range v.list {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("%s: %w", v.flag, err)
+			}
+			*v.to = append(*v.to, re)
+		}
+	}
+	if *minsizeflag != "" {
+		if minsize, err = parseSize(*minsizeflag); err != nil {
+			return fmt.Errorf("min-size: %w", err)
+		}
+	}
+	if *maxsizeflag != "" {
+		if maxsize, err = parseSize(*maxsizeflag); err != nil {
+			return fmt.Errorf("max-size: %w", err)
+		}
+	}
+	if *newerflag != "" {
+		if newer, err = parseAge(*newerflag); err != nil {
+			return fmt.Errorf("newer-than: %w", err)
+		}
+	}
+	if *olderflag != "" {
+		if older, err = parseAge(*olderflag); err != nil {
+			return fmt.Errorf("older-than: %w", err)
+		}
+	}
+	return nil
+}
+
+// namere returns the regular expression for an -include or -exclude
+// glob: one without a slash matches the base name, otherwise the
+// path under the listed directory
+func namere(glob string) (*regexp.Regexp, error) {
+	if !strings.Contains(glob, "/") {
+		glob = "**/" + glob
+	}
+	return globre(strings.TrimPrefix(glob, "/"))
+}
+
+// parseSize parses a size like 1048576, 512k, 10MiB or 1.5GB
+func parseSize(s string) (int64, error) {
+	num, scale := strings.ToLower(strings.TrimSpace(s)), 1.0
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) && !strings.HasSuffix(u.suffix, "bit") {
+			num, scale = num[:len(num)-len(u.suffix)], u.n
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size: %q", s)
+	}
+	return int64(n * scale), nil
+}
+
+// parseAge parses an age like 90m, 36h or 7d into the time that long
+// ago, or a time (see parsetime)
+func parseAge(s string) (time.Time, error) {
+	if d, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64); err == nil && strings.HasSuffix(s, "d") {
+		return time.Now().Add(-time.Duration(d * float64(24*time.Hour))), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return parsetime(s)
+}
+
+// filtering reports whether any filter is set
+func filtering() bool {
+	return len(includes)+len(excludes) > 0 || minsize > 0 || maxsize >= 0 || !newer.IsZero() || !older.IsZero()
+}
+
+// keep reports whether f, listed under root, passes the filters
+func keep(root string, f Info) bool {
+	rel := relpath(uri(root).Path, f.Path)
+	if len(includes) > 0 {
+		ok := false
+		for _, re := range includes {
+			ok = ok || re.MatchString(rel)
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, re := range excludes {
+		if re.MatchString(rel) {
+			return false
+		}
+	}
+	if int64(f.Size) < minsize || maxsize >= 0 && int64(f.Size) > maxsize {
+		return false
+	}
+	if newer.IsZero() && older.IsZero() {
+		return true
+	}
+	t := f.ModTime
+	if t.IsZero() {
+		a, err := statattr(f.String())
+		if err != nil {
+			log.Debug.Add("action", "filter", "file", f.String(), "err", err).Printf("no modification time")
+		}
+		t = a.ModTime
+	}
+	if t.IsZero() {
+		// the age is unknown, so it is neither newer nor older:
+		// -d -older-than must not delete it
+		return false
+	}
+	return !t.Before(newer) && (older.IsZero() || t.Before(older))
+}
+
+// relpath returns file relative to the directory dir, or file if it is
+// not under it
+func relpath(dir, file string) string {
+	if rel, ok := inside(dir, file); ok {
+		return rel
+	}
+	return strings.TrimPrefix(path.Clean("/"+file), "/")
+}
+
+// inside returns the path of file under dir, if it is under dir
+func inside(dir, file string) (rel string, ok bool) {
+	dir = strings.TrimPrefix(path.Clean("/"+dir), "/")
+	file = strings.TrimPrefix(path.Clean("/"+file), "/")
+	if dir == "" {
+		return file, true
+	}
+	if strings.HasPrefix(file, dir+"/") {
+		return file[len(dir)+1:], true
+	}
+	return "", false
+}
+
+// find lists the files under src that its glob, if any, and the
+// filters select. Only the part of src before the glob is listed;
+// buckets narrow the listing to that prefix on the server.
+func find(src string) ([]Info, error) {
+	sfs := driver[uri(src).Scheme]
+	if sfs == nil {
+		return nil, fmt.Errorf("scheme not supported: %s", src)
+	}
+	root := globroot(src)
+	var glob *regexp.Regexp
+	dir := src
+	if hasglob(src) {
+		u := uri(src)
+		re, err := globre(relpath("", u.Path))
+		if err != nil {
+			return nil, err
+		}
+		glob = re
+		switch u.Scheme {
+		case "", "file":
+			dir = root
+		default:
+			u.Path = u.Path[:strings.IndexAny(u.Path, globchars)]
+			dir = u.String()
+		}
+	}
+	list, err := sfs.List(dir)
+	if err != nil || glob == nil && !filtering() {
+		return list, err
+	}
+	found := []Info{}
+	for _, f := range list {
+		if glob != nil && !glob.MatchString(relpath("", f.Path)) {
+			continue
+		}
+		if keep(root, f) {
+			found = append(found, f)
+		}
+	}
+	log.Debug.Add("action", "find", "src", src, "listed", len(list), "found", len(found)).Printf("filtered")
+	return found, nil
+}
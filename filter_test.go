@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		glob, name string
+		want       bool
+	}{
+		{"logs/*/2024-*.gz", "logs/a/2024-01.gz", true},
+		{"logs/*/2024-*.gz", "logs/a/b/2024-01.gz", false},
+		{"logs/**/*.gz", "logs/a/b/x.gz", true},
+		{"logs/**/*.gz", "logs/x.gz", true},
+		{"logs/**", "logs/a/b", true},
+		{"file?.txt", "file1.txt", true},
+		{"file?.txt", "file10.txt", false},
+		{"[ab].txt", "a.txt", true},
+		{"[!ab].txt", "a.txt", false},
+		{"a+b.txt", "a+b.txt", true},
+		{"a.txt", "abtxt", false},
+	} {
+		re, err := globre(tc.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := re.MatchString(tc.name); have != tc.want {
+			t.Errorf("glob %q, name %q: have %v want %v", tc.glob, tc.name, have, tc.want)
+		}
+	}
+	if _, err := globre("a[b"); err == nil {
+		t.Error("unclosed class: want error")
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	for src, want := range map[string]string{
+		"s3://bucket/logs/*/2024-*.gz": "s3://bucket/logs/",
+		"s3://bucket/*.gz":             "s3://bucket/",
+		"/tmp/a/b*":                    "/tmp/a/",
+		"*.gz":                         ".",
+		"s3://bucket/logs/":            "s3://bucket/logs/",
+	} {
+		if have := globroot(src); have != want {
+			t.Errorf("globroot(%q): have %q want %q", src, have, want)
+		}
+	}
+}
+
+func TestParseSizeAge(t *testing.T) {
+	for s, want := range map[string]int64{"100": 100, "512k": 512 << 10, "10MiB": 10 << 20, "1.5GB": 1.5e9} {
+		if have, err := parseSize(s); err != nil || have != want {
+			t.Errorf("parseSize(%q): have %d, %v want %d", s, have, err, want)
+		}
+	}
+	if _, err := parseSize("10mbit"); err == nil {
+		t.Error("parseSize: bits: want error")
+	}
+	for s, want := range map[string]time.Duration{"36h": 36 * time.Hour, "7d": 7 * 24 * time.Hour, "1.5d": 36 * time.Hour} {
+		have, err := parseAge(s)
+		if d := time.Since(have) - want; err != nil || d < 0 || d > time.Minute {
+			t.Errorf("parseAge(%q): have %v, %v", s, have, err)
+		}
+	}
+	if have, _ := parseAge("2024-01-02T00:00:00Z"); !have.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseAge: time: have %v", have)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	defer func() { includes, excludes, minsize, newer = nil, nil, 0, time.Time{} }()
+	in, _ := namere("*.gz")
+	ex, _ := namere("tmp/**")
+	includes, excludes, minsize = append(includes, in), append(excludes, ex), 10
+	newer = time.Now().Add(-time.Hour)
+	info := func(p string, size int, age time.Duration) Info {
+		return Info{URL: &url.URL{Scheme: "s3", Host: "bucket", Path: p}, Size: size, ModTime: time.Now().Add(-age)}
+	}
+	for _, tc := range []struct {
+		f    Info
+		want bool
+	}{
+		{info("logs/a/x.gz", 10, 0), true},
+		{info("logs/x.txt", 10, 0), false},
+		{info("logs/tmp/x.gz", 10, 0), false},
+		{info("logs/x.gz", 9, 0), false},
+		{info("logs/x.gz", 10, 2*time.Hour), false},
+	} {
+		if have := keep("s3://bucket/logs/", tc.f); have != tc.want {
+			t.Errorf("keep(%s): have %v want %v", tc.f, have, tc.want)
+		}
+	}
+}
+
+func TestKeepUnknownTime(t *testing.T) {
+	withbucket(t, prefixfs{})
+	f := Info{URL: &url.URL{Scheme: "s3", Host: "bucket", Path: "logs/x.gz"}}
+	defer func() { newer, older = time.Time{}, time.Time{} }()
+	if !keep("s3://bucket/logs/", f) {
+		t.Fatal("no age filter: want kept")
+	}
+	older = time.Now().Add(-30 * 24 * time.Hour)
+	if keep("s3://bucket/logs/", f) {
+		t.Fatal("-older-than: unknown age kept")
+	}
+	older, newer = time.Time{}, time.Now().Add(-time.Hour)
+	if keep("s3://bucket/logs/", f) {
+		t.Fatal("-newer-than: unknown age kept")
+	}
+}
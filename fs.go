@@ -7,14 +7,11 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"hash"
 	"io"
-	"net"
-	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -26,20 +23,67 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/as/ccp/internal/blake2b"
+	"github.com/as/ccp/internal/xxh64"
 	"github.com/as/log"
 )
 
 var (
 	agent    = flag.String("A", "", "user agent")
 	header   = flag.String("H", "", "http header with colon seperated value (like curl)")
-	tmp      = flag.String("tmp", os.TempDir(), "temporary directory location")
+	tmp      = flag.String("tmp", os.TempDir(), "temporary directory location (comma separated list; blocks go where there is the most free space). orphaned temporary files of crashed runs are removed, except on windows")
 	partsize = flag.Int("partsize", 0, "temporary file partition size")
 	secure   = flag.Bool("secure", true, "(deprecated; see -insecure) disable https to http downgrade when using bucket optimizations")
 	insecure = flag.Bool("insecure", false, "enable https to http downgrade when using bucket optimizations")
 
+	tmpcrypt   = flag.Bool("tmpcrypt", false, "encrypt temporary disk blocks with a random key that only exists in memory")
+	tmpreserve = flag.Int("tmpreserve", 256, "minimum free MiB to leave in a temporary directory; blocks that do not fit wait for space to be freed")
+
 	slow    = flag.Bool("slow", false, "disable parallelism for same-file downloads using temp files (see tmp and partsize)")
 	sign    = flag.Bool("s", false, "presign one or more files (s3 and gs) and output http urls")
-	maxhttp = flag.Int("maxhttp", 24, "global max http connections allowed")
+	maxhttp = flag.Int("maxhttp", 24, "global max http connections allowed; fewer are used while servers throttle ccp (429, 503 or s3 SlowDown)")
+
+	idleconns     = flag.Int("idle", 0, "max idle http connections kept open per host for reuse (zero means maxhttp)")
+	maxconns      = flag.Int("maxconns", 0, "max http connections per host, active or idle (zero means no limit)")
+	rbuf          = flag.Int("rbuf", 64, "read buffer size of an http connection in KiB")
+	wbuf          = flag.Int("wbuf", 64, "write buffer size of an http connection in KiB")
+	dialtimeout   = flag.Duration("dialtimeout", 30*time.Second, "timeout for establishing a tcp connection")
+	keepalive     = flag.Duration("keepalive", 30*time.Second, "interval of tcp keep-alive probes (negative disables them)")
+	idletimeout   = flag.Duration("idletimeout", 90*time.Second, "close idle http connections after this long")
+	tlstimeout    = flag.Duration("tlstimeout", 10*time.Second, "timeout for a tls handshake")
+	headertimeout = flag.Duration("headertimeout", 0, "timeout for the response headers after a request is sent (zero means no timeout)")
+	tlscache      = flag.Int("tlscache", 256, "number of tls sessions cached for resumption (zero disables resumption)")
+	h2strict      = flag.Bool("h2strict", false, "never open another http2 connection to a host whose stream limit is reached; wait for a stream instead")
+	h2window      = flag.Int("h2window", 0, "http2 receive window per stream in KiB (zero means the default)")
+	bind          = flag.String("bind", "", "comma separated local addresses or interface names; connections take turns using them (multi-homed hosts)")
+	fallback      = flag.Duration("fallback", 300*time.Millisecond, "when connecting, try the next address of a host after this long (happy eyeballs)")
+	proxy         = flag.String("proxy", "", "send http, s3 and gs requests through this proxy: http://, https:// or socks5:// with optional user:password@ (default from HTTP_PROXY and HTTPS_PROXY)")
+	noproxy       = flag.String("noproxy", "", "comma separated hosts, domains, ips or cidr blocks to reach without the proxy (like NO_PROXY)")
+	cacert        = flag.String("cacert", "", "comma separated pem files with certificate authorities to trust in addition to the system ones")
+	cert          = flag.String("cert", "", "pem file with a client certificate for tls (may contain the key too)")
+	key           = flag.String("key", "", "pem file with the key of the client certificate")
+	h2ping        = flag.Duration("h2ping", 0, "send an http2 ping after a connection is silent this long and drop it if unanswered (zero disables)")
+
+	mirrors      strlist
+	metalinkfile = flag.String("metalink", "", "read the source url, its mirrors, size and hash from this metalink file")
+	expect       = flag.String("expect", "", "expected digest of the source as algo:hex (e.g. sha256:e3b0...); the copy fails if it does not match")
+
+	verifycp = flag.Bool("verify", false, "after each copy, compare the destination with the data sent: s3 etag, gs md5 and crc32c, or a re-read of a local file; the copy fails on a mismatch")
+	storesum = flag.Bool("storesum", false, "with -verify, store the sha256 of each verified copy as object metadata (s3 and gs)")
+
+	sumfiles  = flag.Bool("sum", false, "print checksum lines (like sha256sum) for the files under each argument; see -hash for the algorithms (default sha256)")
+	checkfile = flag.String("check", "", "verify the files listed in this checksum manifest (from -sum, sha256sum, md5sum, ...); an optional argument is the root they are found under")
+	remotesum = flag.Bool("remotesum", true, "with -sum, -check and -checksum, use the checksums the server computed (s3 etag, gs md5 and crc32c) instead of reading the data")
+	trustsum  = flag.Bool("trustsum", false, "with -remotesum, also use the sha256 stored by -storesum; it is metadata that anyone can set (see -meta), so only when the objects are trusted")
+
+	tee    = flag.Bool("tee", false, "read the first argument once and copy it to every following argument concurrently")
+	quorum = flag.Int("quorum", 0, "with -tee, the number of destinations that must succeed (zero means all)")
+
+	jobs    = flag.Int("j", 0, "max files copied at once (zero means no limit)")
+	jscheme = flag.String("jscheme", "", "per-scheme limits on files copied at once, e.g.: s3=16,gs=8,file=4 (counts the source and destination scheme)")
+	order   = flag.String("order", "list", "order in which files are copied: list (listing order) or size (largest first)")
+
+	prefetchn = flag.Int("prefetch", 4, "with -cat, the number of sources opened and buffered ahead of the one being written, up to 32MiB each (buffers use -maxmem, then -tmp); zero disables")
 
 	recurse = flag.Bool("r", false, "assume input is a directory and attempt recursion")
 
@@ -62,21 +106,76 @@ var (
 	seek     = flag.Int("seek", 0, "source file byte offset to start reading from")
 	count    = flag.Int("count", 0, "source file bytes to read")
 	version  = flag.Bool("v", false, "print version and exit")
-	hashname = flag.String("hash", "", "hashes outgoing data (md5|sha1|sha256|sha384|sha512)")
+	hashname = flag.String("hash", "", "hashes outgoing data (md5|sha1|sha256|sha384|sha512|crc32c|blake2b|xxhash); separate several with commas")
 	nogc     = flag.Bool("nogc", false, "dont delete temporary files (debugging only)")
 	nosort   = flag.Bool("nosort", false, "this is a test flag that disables sorting of partition workers; used for debugging only")
 	ipv4     = flag.Bool("4", false, "forces layer3 ipv4 for s3/http/https files")
+	ipv6     = flag.Bool("6", false, "forces layer3 ipv6 for s3/http/https files")
 	http1    = flag.Bool("1", false, "disables http2 support for all connections")
-	maxmem   = flag.Int("maxmem", 32*1024*1024, "for http without -slow the maximum size at which a block0 will be created in memory instead of the disk; increasing this can reduce latency on slow disk backed storage at the expense of memory utilization")
+	maxmem   = flag.Int("maxmem", 32*1024*1024, "for http without -slow the global memory budget for blocks; blocks are kept in memory while it allows and use the disk otherwise. increasing this can reduce latency on slow disk backed storage at the expense of memory utilization")
 
+	hedge    = flag.Float64("hedge", 5, "for http without -slow, duplicate the request for a block whose throughput is this many times below the median (zero disables)")
 	maxretry = flag.Int("retry", 3, "number of times ccp will retry an http download at a block level instead of terminating when the initial connection fails with a tcp reset")
 
-	del = flag.Bool("d", false, "delete the file provided as the argument (currently not recursive)")
-
-	limitRX = flag.Int("rxlimit", 0, "limit rx bandwidth (in MiB/s)")
+	del = flag.Bool("d", false, "delete the file provided as the argument; with -r or a glob, the files under it that the filters select (see -dry)")
+
+	include     strlist
+	exclude     strlist
+	includere   strlist
+	excludere   strlist
+	minsizeflag = flag.String("min-size", "", "only files of at least this size, e.g. 1048576, 512k, 10MiB (with -r, -ls, -d, -sync, -sum and globs)")
+	maxsizeflag = flag.String("max-size", "", "only files of at most this size (like -min-size)")
+	newerflag   = flag.String("newer-than", "", "only files modified (or uploaded) less than this long ago, like 36h or 7d, or since this rfc 3339 time")
+	olderflag   = flag.String("older-than", "", "only files modified (or uploaded) at least this long ago (like -newer-than)")
+
+	mv       = flag.Bool("mv", false, "move: delete each source once its copy is confirmed (size, and checksums where available); renames local files and uses server side copies within s3 or gs; prints the files it could not move")
+	difftree = flag.Bool("diff", false, "compare two trees: print the files only in the first, only in the second, or in both with different sizes (or checksums, with -checksum); exits with 0 if they are the same, 1 if not and 2 on errors")
+	jsonout  = flag.Bool("json", false, "with -diff, print json lines instead of tab separated ones")
+	bisync   = flag.Bool("bisync", false, "sync two trees both ways: files created, changed or deleted on one side since the last run are on the other (see -baseline and -conflict)")
+	baseline = flag.String("baseline", "", "with -bisync, the file keeping the state of both sides after each run (default: one for the pair in the user cache directory)")
+	conflict = flag.String("conflict", "fail", "with -bisync, what to do with files changed on both sides (or changed on one and deleted on the other): newer (wins), both (keep the older version under a .conflict-<time> name) or fail (leave them and exit with an error)")
+	synctree = flag.Bool("sync", false, "recursively copy only the files that are missing or changed at the destination; unchanged files have the same size and etag or modification time")
+	bysum    = flag.Bool("checksum", false, "with -sync and -diff, compare the checksums of files with the same size instead (see -remotesum)")
+	delextra = flag.Bool("delete", false, "with -sync, delete the files at the destination that are not in the source, after the copies")
+
+	abortstale = flag.Bool("abort", false, "list and abort incomplete multipart uploads under the given prefixes (s3 only, see -age and -dry)")
+	abortage   = flag.Duration("age", 24*time.Hour, "with -abort, only abort uploads initiated at least this long ago")
+
+	resumable = flag.Bool("resume", false, "persist upload state for s3 and gs destinations so an interrupted copy continues where it stopped when rerun")
+	statedir  = flag.String("state", defaultStatedir(), "directory for persistent state (see -resume)")
+
+	limitRX = flag.String("rxlimit", "", "limit rx bandwidth, e.g.: 250Mbit, 1.5GiB/s, or 20 (MiB/s); append @HH:MM-HH:MM to apply only during that time of day, and separate several with commas")
+	limitTX = flag.String("txlimit", "", "limit tx bandwidth (like rxlimit)")
 	spin    = flag.Bool("spin", false, "disable thread release when reading from a very slow connection, this may cause 100% cpu usage if set to true")
+
+	hostlimit, dstlimit strlist
+
+	metaset            strlist
+	usermeta           strlist
+	tags               strlist
+	contenttype        = flag.String("content-type", "", "content type of the destination files (s3, gs and http); by default the source's, or one detected from the file extension and data")
+	cachecontrol       = flag.String("cache-control", "", "cache control of the destination files, overriding the source's")
+	contentencoding    = flag.String("content-encoding", "", "content encoding of the destination files, overriding the source's")
+	contentdisposition = flag.String("content-disposition", "", "content disposition of the destination files, overriding the source's")
+	contentlanguage    = flag.String("content-language", "", "content language of the destination files, overriding the source's")
+	setmeta            = flag.Bool("setmeta", false, "replace the metadata of the s3 and gs objects under each argument in place from -meta, -tag, -metaset, -metadrop and the header flags; s3 objects are copied onto themselves")
+	mimetypes          = flag.String("mimetypes", "", "file mapping extensions to content types in the format of mime.types; these win over detection from the data")
+	metadrop           = flag.String("metadrop", "", "comma separated metadata not carried from the source to the destination: content-type, cache-control, content-encoding, content-disposition, content-language, mtime, a user metadata key, user (all user metadata) or all")
 )
 
+func init() {
+	flag.Var(&hostlimit, "hostlimit", "limit rx bandwidth from one source host or bucket as host=rate (like rxlimit, repeatable)")
+	flag.Var(&dstlimit, "dstlimit", "limit tx bandwidth to one destination host or bucket as host=rate (like rxlimit, repeatable)")
+	flag.Var(&mirrors, "mirror", "an additional url for the source (repeatable); blocks are spread across all of them")
+	flag.Var(&usermeta, "meta", "set user metadata on the destination as key=value (repeatable)")
+	flag.Var(&tags, "tag", "tag the destination as key=value (repeatable); s3 object tags, or metadata on gs, whose objects have no tags")
+	flag.Var(&include, "include", "only files matching this glob (repeatable); a glob without a slash matches the base name, otherwise the path under the listed directory; ** matches across slashes")
+	flag.Var(&exclude, "exclude", "skip files matching this glob (repeatable, like -include)")
+	flag.Var(&includere, "include-re", "only files whose path under the listed directory matches this regular expression (repeatable)")
+	flag.Var(&excludere, "exclude-re", "skip files whose path under the listed directory matches this regular expression (repeatable)")
+	flag.Var(&metaset, "metaset", "set metadata on the destination as name=value, overriding the source's (repeatable); names are like -metadrop, mtime takes rfc 3339 or unix seconds")
+}
+
 var (
 	errNotImplemented = errors.New("not yet implemented")
 )
@@ -111,53 +210,72 @@ func closeAll() {
 }
 
 var hashes = map[string]func() hash.Hash{
-	"md5":    md5.New,
-	"sha1":   sha1.New,
-	"sha256": sha256.New,
-	"sha512": sha512.New,
+	"md5":     md5.New,
+	"sha1":    sha1.New,
+	"sha256":  sha256.New,
+	"sha384":  sha512.New384,
+	"sha512":  sha512.New,
+	"crc32c":  newCRC32C,
+	"blake2b": blake2b.New512,
+	"xxhash":  xxh64.New,
 }
 
 func copyhash(dst io.Writer, src io.Reader) (n int64, sum string, err error) {
-	var h hash.Hash
-	new := hashes[*hashname]
-	if new != nil {
-		h = new()
-		src = io.TeeReader(src, h)
-	}
-	if *limitRX <= 0 {
-		n, err = io.Copy(tx{dst}, rx{src})
-	} else {
-		mbps := int(*limitRX) * 1024 * 1024
-		n, err = io.Copy(tx{dst}, &rxlim{lim: mbps, rx: rx{src}})
-	}
-	if h != nil {
-		sum = fmt.Sprintf("%x", h.Sum(nil))
+	src, hashsum := hashing(src)
+	n, err = io.Copy(tx{dst}, rx{src})
+	return n, hashsum(), err
+}
+
+// hashing returns src read through the -hash hashes, and a function
+// returning their sums of what was read
+func hashing(src io.Reader) (io.Reader, func() string) {
+	names, _ := hashlist(*hashname)
+	if len(names) == 0 {
+		return src, func() string { return "" }
 	}
-	return
+	h := newMultihash(names...)
+	return io.TeeReader(src, h), h.String
 }
 
 func docp(src, dst string, ec chan<- work, donec chan bool) {
+	docpfrom(driver[uri(src).Scheme].Open, src, dst, ec, donec)
+}
+
+// docpfrom is docp with the source opened by open
+func docpfrom(open func(string) (io.ReadCloser, error), src, dst string, ec chan<- work, donec chan bool) {
 	if donec != nil {
 		defer close(donec)
 	}
-	sfs := driver[uri(src).Scheme]
-	dfs := driver[uri(dst).Scheme]
 
 	{
-		sfd, err := sfs.Open(src)
+		sfd, err := open(src)
 		if err != nil {
 			ec <- work{src: src, dst: dst, err: fmt.Errorf("open src: %s: %w", src, err)}
 			return
 		}
 
-		dfd, err := dfs.Create(dst)
+		dfd, err := create(dst, carrier(src))
 		if err != nil {
 			ec <- work{src: src, dst: dst, err: fmt.Errorf("create dst: %s: %w", dst, err)}
 			return
 		}
 		sum := ""
+		// the source is no longer seekable, so a resumed upload
+		// reads the uploaded part through the hashes and digest:
+		// they cover the whole source
+		in, hashsum := hashing(rxlimit(sfd, src))
+		var dg *digest
+		if *verifycp {
+			dg = newDigest(dfd)
+			in = io.TeeReader(in, dg)
+		}
 		if !*test {
-			_, sum, err = copyhash(dfd, sfd)
+			if _, err = resume(dfd, in, src); err != nil {
+				err = fmt.Errorf("resume: %s: %w", dst, err)
+			} else {
+				_, err = io.Copy(tx{txlimit(dfd, dst)}, rx{in})
+				sum = hashsum()
+			}
 		}
 		if err == nil {
 			sfd.Close()
@@ -167,6 +285,12 @@ func docp(src, dst string, ec chan<- work, donec chan bool) {
 				}
 			}
 		}
+		if err == nil && !*test {
+			err = checksum(sum)
+		}
+		if err == nil && dg != nil && !*test {
+			err = verify(dst, dfd, dg, listed(src))
+		}
 		ec <- work{src: src, dst: dst, sum: sum, err: err}
 	}
 }
@@ -174,11 +298,10 @@ func docp(src, dst string, ec chan<- work, donec chan bool) {
 func list(src ...string) {
 	var fatal error
 	for _, src := range src {
-		sfs := driver[uri(src).Scheme]
-		if sfs == nil {
+		if driver[uri(src).Scheme] == nil {
 			log.Fatal.F("src: scheme not supported: %s", src)
 		}
-		dir, err := sfs.List(src)
+		dir, err := find(src)
 		if err != nil {
 			log.Error.F("list error: %q: %v", src, err)
 			fatal = err
@@ -206,11 +329,29 @@ func dodelete(src ...string) {
 		if sfs == nil {
 			log.Fatal.F("src: scheme not supported: %s", src)
 		}
-		err := sfs.Delete(src)
-		if err != nil {
-			log.Error.F("delete error: %q: %v", src, err)
-			fatal = err
-			continue
+		files := []string{src}
+		if *recurse || hasglob(src) {
+			dir, err := find(src)
+			if err != nil {
+				log.Error.F("list error: %q: %v", src, err)
+				fatal = err
+				continue
+			}
+			files = files[:0]
+			for _, f := range dir {
+				files = append(files, f.String())
+			}
+		}
+		for _, file := range files {
+			if *dry {
+				fmt.Printf("ccp -d %q\n", file)
+				continue
+			}
+			err := sfs.Delete(file)
+			if err != nil {
+				log.Error.F("delete error: %q: %v", file, err)
+				fatal = err
+			}
 		}
 	}
 	if fatal != nil {
@@ -223,6 +364,7 @@ var temps = []string{}
 func main() {
 	defer log.Trap()
 	defer closeAll()
+	defer trap()
 
 	flag.Parse()
 	if *version {
@@ -230,45 +372,26 @@ func main() {
 		os.Exit(0)
 	}
 	temps = strings.Split(*tmp, ",")
-
-	log.DebugOn = *debug
-	if *ipv4 {
-		dial := func(network, addr string) (conn net.Conn, err error) {
-			conn, err = net.Dial(network, addr)
-			line := log.Debug.Add("action", "dial", "network", network, "addr", addr)
-			if err != nil {
-				line.Error().Printf("connection failed: %s", err)
-				return
-			}
-			line = line.Add("laddr", conn.LocalAddr().String())
-			line = line.Add("raddr", conn.RemoteAddr().String())
-			if strings.HasPrefix(conn.RemoteAddr().String(), "[") {
-				line.Printf("skipping ipv6")
-				conn.Close()
-				return nil, errors.New("ipv6 disabled")
-			}
-			line.Printf("connected")
-			return conn, err
-		}
-		if *http1 {
-			log.Debug.Printf("bootstrap: ipv4: disable http2 completely")
-			http.DefaultClient.Transport = &http.Transport{
-				Dial:         dial,
-				TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
-			}
-		} else {
-			//
-			log.Debug.Printf("bootstrap: ipv4: will try http1 with custom dialer")
-			http.DefaultClient.Transport = &http.Transport{Dial: dial, ForceAttemptHTTP2: true}
-		}
-	} else if *http1 {
-		log.Debug.Printf("bootstrap: disable http2 completely")
-		http.DefaultClient.Transport = &http.Transport{
-			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	inittemps()
+	if err := initlimits(); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if err := checkmeta(); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if err := initfilter(); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if *mimetypes != "" {
+		if err := readMimeTypes(*mimetypes); err != nil {
+			log.Fatal.F("%v", err)
 		}
 	}
 
-	sema = make(chan bool, *maxhttp)
+	log.DebugOn = *debug
+	inittransport()
+
+	sema = newAIMD("http", *maxhttp)
 	a := flag.Args()
 	if *ls {
 		list(a...)
@@ -278,6 +401,10 @@ func main() {
 		dodelete(a...)
 		os.Exit(0)
 	}
+	if *abortstale {
+		doabortstale(*abortage, a...)
+		os.Exit(0)
+	}
 	if *sign {
 		type S interface {
 			Sign(uri string) (string, error)
@@ -295,6 +422,73 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *metalinkfile != "" {
+		urls, size, sum, err := readMetalink(*metalinkfile)
+		if err != nil {
+			log.Fatal.F("%s: %v", *metalinkfile, err)
+		}
+		a = append([]string{urls[0]}, a...)
+		mirrors = append(mirrors, urls[1:]...)
+		metasize = size
+		if *expect == "" {
+			*expect = sum
+		}
+	}
+	if _, err := hashlist(*hashname); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if *sumfiles {
+		dosum(a...)
+		os.Exit(nerr)
+	}
+	if *checkfile != "" {
+		if len(a) > 1 {
+			log.Fatal.F("usage: ccp -check manifest [root]")
+		}
+		docheck(*checkfile, strings.Join(a, ""))
+		os.Exit(nerr)
+	}
+	if *setmeta {
+		dosetmeta(a...)
+		os.Exit(nerr)
+	}
+	if *difftree {
+		if len(a) != 2 {
+			log.Error.F("usage: ccp -diff a b")
+			os.Exit(2)
+		}
+		dodiff(a[0], a[1])
+	}
+	if *bisync {
+		if len(a) != 2 {
+			log.Fatal.F("usage: ccp -bisync a b")
+		}
+		switch *conflict {
+		case "newer", "both", "fail":
+		default:
+			log.Fatal.F("conflict: want newer, both or fail: %q", *conflict)
+		}
+		dobisync(a[0], a[1])
+		cleanup()
+		os.Exit(nerr)
+	}
+	if *expect != "" {
+		algo, _, _ := strings.Cut(*expect, ":")
+		if hashes[algo] == nil {
+			log.Fatal.F("expect: unsupported hash: %s", algo)
+		}
+		// computed along with the ones given by -hash
+		names, _ := hashlist(*hashname)
+		have := false
+		for _, name := range names {
+			have = have || name == algo
+		}
+		if !have {
+			*hashname = strings.Join(append(names, algo), ",")
+		}
+	}
+	mirrorurls = resolveMirrors(mirrors)
+
 	if len(a) < 2 {
 		log.Fatal.F("usage: ccp src... dst")
 	}
@@ -305,16 +499,43 @@ func main() {
 	if dfs == nil {
 		log.Fatal.F("dst: scheme not supported: %s", a[1])
 	}
+	dsts := a[len(a)-1:]
+	if *tee {
+		// every argument after the source is a destination
+		dsts, a = a[1:], a[:2]
+		for _, dst := range dsts {
+			if driver[uri(dst).Scheme] == nil {
+				log.Fatal.F("dst: scheme not supported: %s", dst)
+			}
+		}
+		if *cat {
+			log.Fatal.F("-tee can not be combined with -cat")
+		}
+	}
 
 	var (
 		list []Info
 		err  error
 	)
-	if strings.HasSuffix(uri(a[0]).Path, "/") {
+	if strings.HasSuffix(uri(a[0]).Path, "/") || *synctree || hasglob(a[0]) {
 		// If it ends in a slash, its obviously a directory
 		// and recursion is implied.
 		*recurse = true
 	}
+	if *synctree && (*tee || *cat || a[0] == "-" || len(a) != 2) {
+		log.Fatal.F("usage: ccp -sync src dst")
+	}
+	if *mv {
+		if *tee || *cat || a[0] == "-" || a[len(a)-1] == "-" || *seek != 0 || *count != 0 || *appendonly || *test {
+			log.Fatal.F("-mv moves whole files from and to named files; it can not be combined with -tee, -cat, -seek, -count, -append or -test")
+		}
+		// the copies are confirmed against the data sent
+		*verifycp = true
+	}
+	if *delextra && hasglob(a[0]) {
+		// the glob says nothing about which files to delete
+		log.Fatal.F("-delete can not be used with a glob, use -include")
+	}
 	if a[0] == "-" && *stdinlist {
 		sc := bufio.NewScanner(os.Stdin)
 		for sc.Scan() {
@@ -333,7 +554,7 @@ func main() {
 			a[0] = path.Dir(a[0])
 		}
 	} else if *recurse {
-		list, err = sfs.List(a[0])
+		list, err = find(a[0])
 		line := log.Error.Add("action", "list", "src", a[0])
 		if err != nil {
 			if *flaky {
@@ -344,6 +565,8 @@ func main() {
 				line.Fatal().Add("err", err).Printf("")
 			}
 		}
+		// copies are relative to the directory before the glob
+		a[0] = globroot(a[0])
 	} else {
 		list = []Info{}
 		for _, file := range a[:len(a)-1] {
@@ -352,14 +575,60 @@ func main() {
 		}
 	}
 
+	var stale []Info
+	if *synctree {
+		list, stale = syncplan(a[0], list, a[1])
+	}
+
+	if len(mirrorurls) > 0 && len(list) > 1 {
+		log.Fatal.F("mirrors can only be used with a single source file")
+	}
+
 	ec := make(chan work, len(a)+len(list))
 	n := 0
 	lastarg := a[len(a)-1]
-	if lastarg == "-" {
+	if lastarg == "-" && !*tee {
 		*cat = true
 	}
-	var donec chan bool
+	var (
+		donec chan bool
+		pf    *prefetch
+	)
+	if *cat && *prefetchn > 0 && len(list) > 1 && !*dry {
+		src := make([]string, len(list))
+		for i := range list {
+			src[i] = list[i].String()
+		}
+		pf = newPrefetch(src, *prefetchn)
+	}
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if !*cat {
+		if err := schedule(list, *order); err != nil {
+			log.Fatal.F("%v", err)
+		}
+	}
 	for i, src := range list {
+		if *tee {
+			dst, quoted := []string{}, ""
+			for _, root := range dsts {
+				d := src2dst(a[0], src.String(), root)
+				dst = append(dst, d.String())
+				quoted += fmt.Sprintf(" %q", d.String())
+			}
+			if *dry {
+				fmt.Printf("ccp -tee %q%s # %d\n", src, quoted, src.Size)
+			} else {
+				addquota(src.Size)
+				setlisted(src)
+				src := src.String()
+				q.add(func() { doteecp(src, dst, ec) }, src, dst...)
+				n++
+			}
+			continue
+		}
 		dst := src2dst(a[0], src.String(), lastarg) // TODO(as): bug, shouldnt be a[0]
 		if *cat {
 			donec = make(chan bool)
@@ -369,21 +638,44 @@ func main() {
 			}
 		}
 		if *dry {
-			fmt.Printf("ccp %q %q # %d\n", src, dst.String(), src.Size)
+			cmd := "ccp"
+			if *mv {
+				cmd = "ccp -mv"
+			}
+			fmt.Printf("%s %q %q # %d\n", cmd, src, dst.String(), src.Size)
 		} else {
 			addquota(src.Size)
-			go docp(src.String(), dst.String(), ec, donec)
-			if donec != nil {
+			setlisted(src)
+			if pf != nil {
+				go func(i int) {
+					docpfrom(func(string) (io.ReadCloser, error) { return pf.open(i) }, src.String(), dst.String(), ec, donec)
+					pf.done(i)
+				}(i)
+				if i+1 != len(list) {
+					<-donec
+				}
+			} else if donec != nil {
+				go docp(src.String(), dst.String(), ec, donec)
 				if i+1 != len(list) {
 					<-donec
 				}
+			} else if *mv {
+				src, dst := src.String(), dst.String()
+				q.add(func() { domv(src, dst, ec) }, src, dst)
+			} else {
+				src, dst := src.String(), dst.String()
+				q.add(func() { docp(src, dst, ec, nil) }, src, dst)
 			}
 			n++
 		}
 	}
 	if *dry {
+		for _, f := range stale {
+			fmt.Printf("ccp -d %q # %d\n", f, f.Size)
+		}
 		os.Exit(0)
 	}
+	q.run()
 
 	tick := time.NewTicker(time.Second).C
 	stopmon := make(chan bool)
@@ -407,13 +699,25 @@ func main() {
 				return true
 			})
 		case msg := <-fatal:
+			abortUploads()
 			cleanup()
 			log.Fatal.F("%s", msg)
 		case sig := <-killc:
+			abortUploads()
 			cleanup()
 			log.Fatal.F("trapped signal: %s", sig)
 		case w := <-ec:
 			i++
+			if *mv {
+				// logged by domv, and reported at the end
+				if w.err != nil {
+					unmoved = append(unmoved, w)
+					nerr++
+				} else {
+					moved = append(moved, localize(w.src))
+				}
+				continue
+			}
 			line := log.Info.Add("action", "copy", "src", w.src, "dst", w.dst, "hashname", *hashname, "hash", w.sum, "err", w.err)
 			if w.err != nil {
 				line = log.Error.Add("status", "failed", "err", w.err)
@@ -421,6 +725,7 @@ func main() {
 				if *flaky {
 					line.Printf("copy error: %s -> %s: %v", w.src, w.dst, w.err)
 				} else {
+					abortUploads()
 					cleanup()
 					line.Fatal().F("copy error: %s -> %s: %v", w.src, w.dst, w.err)
 				}
@@ -434,8 +739,21 @@ func main() {
 	close(stopmon)
 
 	progress(n, n)
+	cleanup()
+	if *mv {
+		report()
+		if *recurse && localscheme(uri(a[0]).Scheme) {
+			rmdirs(localize(a[0]), moved)
+		}
+	}
+	if len(stale) > 0 {
+		if nerr != 0 {
+			log.Error.Add("action", "sync", "stale", len(stale)).Printf("copy errors, not deleting")
+		} else {
+			prune(stale)
+		}
+	}
 	if nerr != 0 {
-		cleanup()
 		os.Exit(nerr)
 	}
 }
@@ -552,11 +870,16 @@ type Info struct {
 	// invariant: *url.URL is never nil
 	*url.URL
 	Size int
+	// ModTime is the time the listing has, if any: the
+	// modification time of a local file or the upload time
+	// of an object
+	ModTime time.Time
 }
 
+// prefix returns the directory of path before any glob
 func prefix(path string) string {
-	n := strings.IndexAny(path, "*?[")
-	if n > 0 {
+	n := strings.IndexAny(path, globchars)
+	if n >= 0 {
 		path = path[:n]
 	}
 	n = strings.LastIndex(path, "/")
@@ -602,3 +925,13 @@ func commonPrefix(file ...Info) string {
 	}
 	return path.Join(append([]string{"/"}, min...)...)
 }
+
+// strlist is a repeatable string flag
+type strlist []string
+
+func (s *strlist) String() string { return strings.Join(*s, ",") }
+
+func (s *strlist) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
@@ -1,25 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/as/log"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 type GS struct {
 	ctx context.Context
 	c   *storage.Client
+	hc  *http.Client // authenticated client, also for resumable uploads
 	err error
 }
 
-func (g *GS) Delete(dir string) (err error) {
-	return errors.New("not yet implemented")
+func (g *GS) Delete(file string) (err error) {
+	if !g.ensure() {
+		return g.err
+	}
+	u := uri(file)
+	return g.c.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).Delete(g.ctx)
 }
 
 func (g *GS) ensure() bool {
@@ -27,7 +38,12 @@ func (g *GS) ensure() bool {
 		g.ctx = context.Background()
 	}
 	if g.c == nil {
-		g.c, g.err = storage.NewClient(g.ctx)
+		var rt http.RoundTripper
+		rt, g.err = htransport.NewTransport(g.ctx, newTransport(), option.WithScopes(storage.ScopeFullControl))
+		if g.err == nil {
+			g.hc = &http.Client{Transport: rt}
+			g.c, g.err = storage.NewClient(g.ctx, option.WithHTTPClient(g.hc))
+		}
 	}
 	return g.err == nil
 }
@@ -47,7 +63,7 @@ func (g *GS) List(dir string) (file []Info, err error) {
 		}
 		u := u
 		u.Path = attr.Name
-		file = append(file, Info{URL: &u, Size: int(attr.Size)})
+		file = append(file, Info{URL: &u, Size: int(attr.Size), ModTime: attr.Updated})
 	}
 	return file, err
 }
@@ -66,6 +82,14 @@ func (g *GS) Open(file string) (io.ReadCloser, error) {
 	//	if err == nil {
 	//		return HTTP{}.Open(su)
 	//	}
+	//
+	// The exception is a download from several mirrors, which
+	// only the accelerator can do.
+	if len(mirrorurls) > 0 {
+		if su, err := g.Sign(file); err == nil {
+			return HTTP{}.Open(su)
+		}
+	}
 
 	u := uri(file)
 	u.Path = strings.TrimPrefix(u.Path, "/")
@@ -74,13 +98,153 @@ func (g *GS) Open(file string) (io.ReadCloser, error) {
 }
 
 func (g *GS) Create(file string) (io.WriteCloser, error) {
+	return g.CreateMeta(file, Meta{})
+}
+
+// CreateMeta is Create with the object attributes and metadata in m
+func (g *GS) CreateMeta(file string, m Meta) (io.WriteCloser, error) {
 	if !g.ensure() {
 		return nil, g.err
 	}
 	u := uri(file)
 	u.Path = strings.TrimPrefix(u.Path, "/")
 	log.Debug.Add("host", u.Host, "path", u.Path).Printf("create")
-	return g.c.Bucket(u.Host).Object(u.Path).NewWriter(g.ctx), nil
+	if *resumable {
+		return &gsresumable{hc: g.hc, u: u, dst: file, meta: m}, nil
+	}
+	obj := g.c.Bucket(u.Host).Object(u.Path)
+	return &headwriter{open: func(head []byte) (io.WriteCloser, error) {
+		ctx, cancel := context.WithCancel(g.ctx)
+		w := obj.NewWriter(ctx)
+		w.ContentType = m.contentType(u.Path, head)
+		w.CacheControl = m.CacheControl
+		w.ContentEncoding = m.ContentEncoding
+		w.ContentDisposition = m.ContentDisposition
+		w.ContentLanguage = m.ContentLanguage
+		w.Metadata = m.metadata()
+		return gswriter{Writer: w, cancel: cancel}, nil
+	}}, nil
+}
+
+// Stat returns the size, checksums and metadata of file
+func (g *GS) Stat(file string) (a Attr, err error) {
+	if !g.ensure() {
+		return a, g.err
+	}
+	u := uri(file)
+	attr, err := g.c.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).Attrs(g.ctx)
+	if err != nil {
+		return a, err
+	}
+	a.Size = attr.Size
+	a.MD5 = attr.MD5 // composite objects have none
+	a.CRC32C = &attr.CRC32C
+	a.ContentType = attr.ContentType
+	a.CacheControl = attr.CacheControl
+	a.ContentEncoding = attr.ContentEncoding
+	a.ContentDisposition = attr.ContentDisposition
+	a.ContentLanguage = attr.ContentLanguage
+	a.setUser(attr.Metadata, attr.Updated)
+	return a, nil
+}
+
+// SetMeta adds meta to the metadata of file
+func (g *GS) SetMeta(file string, meta map[string]string) error {
+	if !g.ensure() {
+		return g.err
+	}
+	u := uri(file)
+	_, err := g.c.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).Update(g.ctx, storage.ObjectAttrsToUpdate{Metadata: meta})
+	return err
+}
+
+// ReplaceMeta replaces the attributes and metadata of file with those
+// in m. The update is in place, but it can only add metadata, so
+// metadata that m does not have is deleted first.
+func (g *GS) ReplaceMeta(file string, m Meta) error {
+	if !g.ensure() {
+		return g.err
+	}
+	u := uri(file)
+	obj := g.c.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/"))
+	attr, err := obj.Attrs(g.ctx)
+	if err != nil {
+		return err
+	}
+	meta := m.metadata()
+	for k := range attr.Metadata {
+		if _, ok := meta[k]; !ok {
+			// an empty map deletes all of it
+			attr, err = obj.If(storage.Conditions{MetagenerationMatch: attr.Metageneration}).Update(g.ctx, storage.ObjectAttrsToUpdate{Metadata: map[string]string{}})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	// empty fields are deleted
+	_, err = obj.If(storage.Conditions{MetagenerationMatch: attr.Metageneration}).Update(g.ctx, storage.ObjectAttrsToUpdate{
+		ContentType:        m.ContentType,
+		CacheControl:       m.CacheControl,
+		ContentEncoding:    m.ContentEncoding,
+		ContentDisposition: m.ContentDisposition,
+		ContentLanguage:    m.ContentLanguage,
+		Metadata:           meta,
+	})
+	return err
+}
+
+// ServerCopy copies src to dst, both in gs, with the metadata in m
+func (g *GS) ServerCopy(src, dst string, m Meta) error {
+	if !g.ensure() {
+		return g.err
+	}
+	su, du := uri(src), uri(dst)
+	from := g.c.Bucket(su.Host).Object(strings.TrimPrefix(su.Path, "/"))
+	c := g.c.Bucket(du.Host).Object(strings.TrimPrefix(du.Path, "/")).CopierFrom(from)
+	c.ContentType = m.ContentType
+	c.CacheControl = m.CacheControl
+	c.ContentEncoding = m.ContentEncoding
+	c.ContentDisposition = m.ContentDisposition
+	c.ContentLanguage = m.ContentLanguage
+	c.Metadata = m.metadata()
+	_, err := c.Run(g.ctx)
+	return err
+}
+
+// metadata returns the user metadata in m with its tags; gs objects
+// have no tags (or labels, like buckets)
+func (m Meta) metadata() map[string]string {
+	u := m.user()
+	for k, v := range m.Tags {
+		u[k] = v
+	}
+	return u
+}
+
+// gswriter reports the outcome of an upload to upsema; the storage
+// client retries throttled chunks itself
+type gswriter struct {
+	*storage.Writer
+	cancel func()
+}
+
+func (w gswriter) Close() error {
+	defer w.cancel()
+	err := w.Writer.Close()
+	if after, ok := isThrottle(err); ok {
+		upsema.throttle(after)
+	} else if err == nil {
+		upsema.ok()
+	}
+	return err
+}
+
+// Abort cancels the upload; the object is not created
+func (w gswriter) Abort() error {
+	w.cancel()
+	w.Writer.Close()
+	return nil
 }
 
 func (f GS) Close() error {
@@ -104,3 +268,213 @@ func (g *GS) sign(dir string) (string, error) {
 	}
 	return g.c.Bucket(u.Host).SignedURL(u.Path, opt)
 }
+
+// gsresumable is a gs upload through a resumable session. The
+// session uri is persisted with upstate, so a later process writing
+// the same destination from the same source can continue it.
+type gsresumable struct {
+	hc   *http.Client
+	u    url.URL
+	dst  string
+	meta Meta
+
+	st  *upstate
+	buf []byte
+	off int64 // bytes committed by the server
+}
+
+// gschunk is the resumable upload chunk size; gs requires
+// a multiple of 256KiB
+const gschunk = 64 * 256 * 1024
+
+func (g *gsresumable) init() {
+	if g.st == nil {
+		g.st = &upstate{Dst: g.dst, file: statefile(g.dst), PartSize: gschunk}
+	}
+}
+
+func (g *gsresumable) Resume(fp string, size int) (int64, error) {
+	st := loadState(g.dst)
+	g.st = &upstate{Dst: g.dst, file: st.file, Fingerprint: fp, PartSize: gschunk}
+	if st.Session == "" {
+		return 0, nil
+	}
+	if fp == "" {
+		st.done()
+		return 0, nil
+	}
+	if st.Fingerprint != fp {
+		log.Warn.Add("dst", g.dst).Printf("gs: source changed since last upload attempt, starting over")
+		st.done()
+		return 0, nil
+	}
+	committed, err := g.query(st.Session)
+	if err != nil {
+		log.Warn.Add("dst", g.dst, "err", err).Printf("gs: can not query previous upload session, starting over")
+		st.done()
+		return 0, nil
+	}
+	g.st.Session = st.Session
+	g.off = committed
+	return committed, nil
+}
+
+// query returns the number of bytes the server has for the session
+func (g *gsresumable) query(session string) (int64, error) {
+	req, err := http.NewRequest("PUT", session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	resp, err := g.hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 308 {
+		return 0, fmt.Errorf("gs: query session: %s", resp.Status)
+	}
+	return committed(resp), nil
+}
+
+// committed parses the Range header of a 308 response
+func committed(resp *http.Response) int64 {
+	a, b := int64(0), int64(-1)
+	fmt.Sscanf(resp.Header.Get("Range"), "bytes=%d-%d", &a, &b)
+	return b + 1
+}
+
+func (g *gsresumable) start() error {
+	content := g.meta.contentType(g.u.Path, g.buf)
+	q := url.Values{"uploadType": {"resumable"}, "name": {g.u.Path}}
+	attrs := map[string]interface{}{"contentType": content, "metadata": g.meta.metadata()}
+	for k, v := range map[string]string{
+		"cacheControl":       g.meta.CacheControl,
+		"contentEncoding":    g.meta.ContentEncoding,
+		"contentDisposition": g.meta.ContentDisposition,
+		"contentLanguage":    g.meta.ContentLanguage,
+	} {
+		if v != "" {
+			attrs[k] = v
+		}
+	}
+	body, _ := json.Marshal(attrs)
+	req, err := http.NewRequest("POST", "https://storage.googleapis.com/upload/storage/v1/b/"+url.PathEscape(g.u.Host)+"/o?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", content)
+	resp, err := g.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("gs: start resumable upload: %s", resp.Status)
+	}
+	g.st.Lock()
+	defer g.st.Unlock()
+	g.st.Session = resp.Header.Get("Location")
+	if err = g.st.save(); err != nil {
+		log.Warn.Add("dst", g.dst, "err", err).Printf("gs: upload will not be resumable")
+	}
+	return nil
+}
+
+// send uploads the buffer at the current offset. The total is
+// only known for the final chunk, otherwise it is -1.
+func (g *gsresumable) send(total int64) error {
+	if g.st.Session == "" {
+		if err := g.start(); err != nil {
+			return err
+		}
+	}
+	for attempt, throttles := 0, 0; ; {
+		end := g.off + int64(len(g.buf)) - 1
+		crange := fmt.Sprintf("bytes %d-%d/*", g.off, end)
+		switch {
+		case total >= 0 && len(g.buf) == 0:
+			crange = fmt.Sprintf("bytes */%d", total)
+		case total >= 0:
+			crange = fmt.Sprintf("bytes %d-%d/%d", g.off, end, total)
+		}
+		req, err := http.NewRequest("PUT", g.st.Session, bytes.NewReader(g.buf))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Range", crange)
+		upsema.acquire()
+		resp, err := g.hc.Do(req)
+		upsema.release()
+		if err == nil {
+			resp.Body.Close()
+			if terr := throttled(resp); terr != nil {
+				after, _ := isThrottle(terr)
+				upsema.throttle(after)
+				throttles++
+				log.Warn.Add("err", terr).F("gs: upload chunk at %d (throttled %d times)", g.off, throttles)
+				time.Sleep(backoff(throttles, terr))
+				continue
+			}
+			upsema.ok()
+			switch resp.StatusCode {
+			case 200, 201:
+				g.off += int64(len(g.buf))
+				g.buf = g.buf[:0]
+				return nil
+			case 308:
+				done := committed(resp) - g.off
+				if done < 0 || done > int64(len(g.buf)) {
+					return fmt.Errorf("gs: server committed unexpected range: %s", resp.Header.Get("Range"))
+				}
+				g.off += done
+				g.buf = append(g.buf[:0], g.buf[done:]...)
+				if len(g.buf) == 0 && total < 0 {
+					return nil
+				}
+				continue
+			}
+			err = fmt.Errorf("gs: upload chunk: %s", resp.Status)
+			if resp.StatusCode/100 == 4 {
+				return err
+			}
+		}
+		if attempt++; attempt > *maxretry {
+			return err
+		}
+		log.Error.Add("err", err).F("gs: upload chunk at %d (attempt %d/%d)", g.off, attempt, *maxretry)
+		time.Sleep(backoff(attempt, err))
+	}
+}
+
+func (g *gsresumable) Write(p []byte) (n int, err error) {
+	g.init()
+	for len(p) > 0 {
+		k := gschunk - len(g.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		g.buf = append(g.buf, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(g.buf) == gschunk {
+			if err = g.send(-1); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Abort leaves the session unfinished, so it can be resumed
+func (g *gsresumable) Abort() error { return nil }
+
+func (g *gsresumable) Close() error {
+	g.init()
+	if err := g.send(g.off + int64(len(g.buf))); err != nil {
+		return err
+	}
+	g.st.done()
+	return nil
+}
@@ -87,6 +87,41 @@ func httpsize(dir string) (size int, err error) {
 	return size, err
 }
 
+// Stat returns the size and metadata of file from the headers of a
+// request for its first byte (some servers refuse HEAD requests)
+func (f HTTP) Stat(file string) (a Attr, err error) {
+	r, err := newHTTPRequest("GET", file, nil)
+	if err != nil {
+		return a, err
+	}
+	r.Header.Add("Range", "bytes=0-0")
+	resp, err := http.DefaultClient.Do(r)
+	if *debug {
+		logopen("stat", file, resp, err)
+	}
+	if err != nil {
+		return a, err
+	}
+	// a server that ignores the range sends the whole file, so
+	// only a small body is read for the connection to be reused
+	io.CopyN(ioutil.Discard, resp.Body, 64<<10)
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		a.Size = resp.ContentLength
+	case 206:
+		x, y := 0, 0
+		if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &x, &y, &a.Size); err != nil {
+			return a, fmt.Errorf("http: bad content range: %w", err)
+		}
+	case 416:
+	default:
+		return a, fmt.Errorf("http: %s", resp.Status)
+	}
+	a.Meta = headerMeta(resp.Header)
+	return a, nil
+}
+
 func (f HTTP) Open(file string) (io.ReadCloser, error) {
 	if *slow {
 		return f.open(file)
@@ -121,12 +156,20 @@ Retry:
 	}
 	if attempt >= *maxretry && err != nil {
 		log.Error.Add("err", err).F("downloading file %s", file)
+		return nil, err
 	} else if err != nil {
 		attempt++
 		log.Error.Add("err", err).F("downloading file %s (attempt %d/%d)", file, attempt, *maxretry)
 		time.Sleep(time.Duration(attempt) * time.Second)
 		goto Retry
 	}
+	if terr := throttled(resp); terr != nil && attempt < *maxretry {
+		resp.Body.Close()
+		attempt++
+		log.Warn.Add("err", terr).F("downloading file %s (attempt %d/%d)", file, attempt, *maxretry)
+		time.Sleep(backoff(attempt, terr))
+		goto Retry
+	}
 	if resp.StatusCode >= 400 {
 		err = fmt.Errorf("status: %v", resp.StatusCode)
 		// NOTE(as): bug here with connection reuse
@@ -137,7 +180,88 @@ Retry:
 }
 
 func (f HTTP) Create(file string) (io.WriteCloser, error) {
-	return nil, fmt.Errorf("http: create: not implemented yet")
+	return f.CreateMeta(file, Meta{})
+}
+
+// CreateMeta uploads file with a PUT request carrying the standard
+// headers in m. The size is not known in advance, so the body is
+// sent in chunks.
+func (f HTTP) CreateMeta(file string, m Meta) (io.WriteCloser, error) {
+	f.ensure()
+	return &headwriter{open: func(head []byte) (io.WriteCloser, error) {
+		pr, pw := io.Pipe()
+		req, err := newHTTPRequest("PUT", file, pr)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(f.ctx)
+		for name, v := range m.fields() {
+			if *v != "" {
+				req.Header.Set(name, *v)
+			}
+		}
+		req.Header.Set("Content-Type", m.contentType(uri(file).Path, head))
+		put := &httpput{PipeWriter: pw, done: make(chan error, 1)}
+		go func() {
+			upsema.acquire()
+			resp, err := http.DefaultClient.Do(req)
+			upsema.release()
+			if *debug {
+				logopen("put", file, resp, err)
+			}
+			if err == nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if terr := throttled(resp); terr != nil {
+					after, _ := isThrottle(terr)
+					upsema.throttle(after)
+					err = terr
+				} else if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("http: put: %s", resp.Status)
+				} else {
+					upsema.ok()
+				}
+			}
+			pr.CloseWithError(err)
+			put.done <- err
+		}()
+		return put, nil
+	}}, nil
+}
+
+type httpput struct {
+	*io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (p *httpput) Write(b []byte) (int, error) {
+	n, err := p.PipeWriter.Write(b)
+	if err != nil {
+		// the request ended early, its error says why
+		if rerr := p.wait(); rerr != nil {
+			err = rerr
+		}
+	}
+	return n, err
+}
+
+func (p *httpput) wait() error {
+	p.once.Do(func() { p.err = <-p.done })
+	return p.err
+}
+
+func (p *httpput) Close() error {
+	p.PipeWriter.Close()
+	return p.wait()
+}
+
+// Abort ends the request body with an error, so the upload fails
+func (p *httpput) Abort() error {
+	p.PipeWriter.CloseWithError(errAborted)
+	p.wait()
+	return nil
 }
 
 func (f HTTP) Close() error { return nil }
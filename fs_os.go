@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/as/log"
 )
 
 type OS struct {
@@ -29,7 +31,7 @@ func (f OS) List(dir string) (file []Info, err error) {
 		if !info.IsDir() {
 			u := u
 			u.Path = p
-			file = append(file, Info{URL: &u, Size: int(info.Size())})
+			file = append(file, Info{URL: &u, Size: int(info.Size()), ModTime: info.ModTime()})
 		}
 		return nil
 	})
@@ -67,6 +69,73 @@ func (f OS) Create(file string) (w io.WriteCloser, err error) {
 	return w, err
 }
 
+// Stat returns the size and metadata of file. The metadata are the
+// modification time and the user.* extended attributes, where
+// user.mime_type is the content type.
+func (f OS) Stat(file string) (a Attr, err error) {
+	file = localize(file)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return a, err
+	}
+	a.Size = fi.Size()
+	a.setUser(getxattrs(file), fi.ModTime())
+	if ct, ok := a.User["mime_type"]; ok {
+		a.ContentType = ct
+		delete(a.User, "mime_type")
+	}
+	return a, nil
+}
+
+// CreateMeta is Create with the modification time, content type and
+// user metadata in m applied when the file is closed
+func (f OS) CreateMeta(file string, m Meta) (io.WriteCloser, error) {
+	w, err := f.Create(file)
+	fd, ok := w.(*os.File)
+	if err != nil || !ok || fd == os.Stdout || *appendonly {
+		return w, err
+	}
+	return &osfile{File: fd, meta: m}, nil
+}
+
+type osfile struct {
+	*os.File
+	meta Meta
+}
+
+// Abort removes the partial file
+func (f *osfile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+func (f *osfile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	attr := map[string]string{}
+	for k, v := range f.meta.User {
+		attr[k] = v
+	}
+	if f.meta.ContentType != "" {
+		attr["mime_type"] = f.meta.ContentType
+	}
+	if err := setxattrs(f.Name(), attr); err != nil {
+		log.Debug.Add("action", "meta", "file", f.Name(), "err", err).Printf("extended attributes not set")
+	}
+	if t := f.meta.ModTime; !t.IsZero() {
+		return os.Chtimes(f.Name(), t, t)
+	}
+	return nil
+}
+
+// Rename renames src to dst, creating the directory of dst
+func (f OS) Rename(src, dst string) error {
+	src, dst = localize(src), localize(dst)
+	os.MkdirAll(filepath.Dir(dst), 0777)
+	return os.Rename(src, dst)
+}
+
 func (f OS) Close() error { return nil }
 
 func localize(file string) string {
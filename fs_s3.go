@@ -2,19 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
 	//	"path"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/as/log"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	s3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -39,12 +45,17 @@ func (g *S3) Delete(dir string) (err error) {
 	dir = strings.TrimPrefix(u.Path, "/")
 
 	list := []*s3.ObjectIdentifier{{Key: &dir}}
-	_, err = gc.DeleteObjects(&s3.DeleteObjectsInput{
+	o, err := gc.DeleteObjects(&s3.DeleteObjectsInput{
 		Bucket: &u.Host,
 		Delete: &s3.Delete{
 			Objects: list,
 		},
 	})
+	if err == nil && len(o.Errors) > 0 {
+		// the request succeeds when the deletions do not
+		e := o.Errors[0]
+		err = fmt.Errorf("s3: delete: %s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message))
+	}
 	return err
 }
 
@@ -59,10 +70,12 @@ func (g *S3) ensure() bool {
 	}
 	<-regionDetected
 	if g.c == nil {
-		s, err := session.NewSession()
+		s, err := session.NewSession(&aws.Config{HTTPClient: http.DefaultClient})
 		g.s = s
 		g.err = err
 		if err == nil {
+			s.Handlers.Retry.PushBack(s3feedback)
+			s.Handlers.Complete.PushBack(s3feedback)
 			g.c = s3.New(s)
 			g.u = s3m.NewUploader(s)
 		}
@@ -76,7 +89,8 @@ func (g *S3) regionize(file string) (s3c *s3.S3, s3u *s3m.Uploader) {
 		if s3u != nil {
 			//s3u.PartSize = 256 * 1024 * 1024
 			s3u.PartSize = 32 * 1024 * 1024
-			s3u.Concurrency = 16
+			s3u.Concurrency = maxupload
+			s3u.RequestOptions = []request.Option{s3parts}
 		}
 	}()
 	native := os.Getenv("AWS_REGION")
@@ -97,11 +111,14 @@ func (g *S3) regionize(file string) (s3c *s3.S3, s3u *s3m.Uploader) {
 		return g.c, g.u
 	}
 	sess, _ := session.NewSession(&aws.Config{
-		Region: &r,
+		Region:     &r,
+		HTTPClient: http.DefaultClient,
 	})
 	if sess == nil {
 		return g.c, g.u
 	}
+	sess.Handlers.Retry.PushBack(s3feedback)
+	sess.Handlers.Complete.PushBack(s3feedback)
 	return s3.New(sess), s3m.NewUploader(sess)
 }
 
@@ -124,7 +141,7 @@ Unroll:
 		u := u
 		u.Path = *v.Key
 		file = append(file,
-			Info{URL: &u, Size: int(*v.Size)},
+			Info{URL: &u, Size: int(*v.Size), ModTime: aws.TimeValue(v.LastModified)},
 		)
 	}
 	if v := o.NextContinuationToken; v != nil {
@@ -156,12 +173,219 @@ func (g *S3) Open(file string) (io.ReadCloser, error) {
 	return o.Body, nil
 }
 
+// Stat returns the size, etag and metadata of file
+func (g *S3) Stat(file string) (a Attr, err error) {
+	if !g.ensure() {
+		return a, g.err
+	}
+	gc, _ := g.regionize(file)
+	u := uri(file)
+	o, err := gc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &u.Host,
+		Key:    &u.Path,
+	})
+	if err != nil {
+		return a, err
+	}
+	a.Size = aws.Int64Value(o.ContentLength)
+	a.ETag = aws.StringValue(o.ETag)
+	// with sse-kms and sse-c the etag is not the md5 of the data
+	a.Opaque = aws.StringValue(o.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms || o.SSECustomerAlgorithm != nil
+	a.ContentType = aws.StringValue(o.ContentType)
+	a.CacheControl = aws.StringValue(o.CacheControl)
+	a.ContentEncoding = aws.StringValue(o.ContentEncoding)
+	a.ContentDisposition = aws.StringValue(o.ContentDisposition)
+	a.ContentLanguage = aws.StringValue(o.ContentLanguage)
+	a.setUser(aws.StringValueMap(o.Metadata), aws.TimeValue(o.LastModified))
+	return a, nil
+}
+
+// SetMeta adds meta to the user metadata of file. S3 can not change
+// the metadata of an object in place, so the object is copied onto
+// itself, which is limited to 5GiB.
+func (g *S3) SetMeta(file string, meta map[string]string) error {
+	if !g.ensure() {
+		return g.err
+	}
+	gc, _ := g.regionize(file)
+	u := uri(file)
+	o, err := gc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &u.Host,
+		Key:    &u.Path,
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(o.ContentLength) > 5<<30 {
+		return fmt.Errorf("s3: object larger than 5GiB, metadata can not be replaced")
+	}
+	m := o.Metadata
+	if m == nil {
+		m = map[string]*string{}
+	}
+	for k, v := range meta {
+		m[k] = aws.String(v)
+	}
+	src := (&url.URL{Path: u.Host + "/" + strings.TrimPrefix(u.Path, "/")}).EscapedPath()
+	_, err = gc.CopyObject(&s3.CopyObjectInput{
+		Bucket:               &u.Host,
+		Key:                  &u.Path,
+		CopySource:           &src,
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             m,
+		ContentType:          o.ContentType,
+		ContentEncoding:      o.ContentEncoding,
+		ContentDisposition:   o.ContentDisposition,
+		ContentLanguage:      o.ContentLanguage,
+		CacheControl:         o.CacheControl,
+		StorageClass:         o.StorageClass,
+		ServerSideEncryption: o.ServerSideEncryption,
+		SSEKMSKeyId:          o.SSEKMSKeyId,
+	})
+	if err != nil {
+		return err
+	}
+	// the copy has the default acl, not the one Create applied
+	acl, grants := g.uploadACL(u.Host)
+	putACL(gc, u, acl, grants)
+	return nil
+}
+
+// ReplaceMeta replaces the headers and user metadata of file with
+// those in m, and its tags if m has any. Like SetMeta it copies the
+// object onto itself; the copy gets the acl of the original, or -acl.
+func (g *S3) ReplaceMeta(file string, m Meta) error {
+	if !g.ensure() {
+		return g.err
+	}
+	gc, _ := g.regionize(file)
+	u := uri(file)
+	o, err := gc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &u.Host,
+		Key:    &u.Path,
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(o.ContentLength) > 5<<30 {
+		return fmt.Errorf("s3: object larger than 5GiB, metadata can not be replaced")
+	}
+	var policy *s3.AccessControlPolicy
+	if *acl == "" {
+		a, err := gc.GetObjectAcl(&s3.GetObjectAclInput{Bucket: &u.Host, Key: &u.Path})
+		if err != nil {
+			return err
+		}
+		policy = &s3.AccessControlPolicy{Grants: a.Grants, Owner: a.Owner}
+	}
+	directive := s3.TaggingDirectiveCopy
+	if len(m.Tags) > 0 {
+		directive = s3.TaggingDirectiveReplace
+	}
+	src := (&url.URL{Path: u.Host + "/" + strings.TrimPrefix(u.Path, "/")}).EscapedPath()
+	_, err = gc.CopyObject(&s3.CopyObjectInput{
+		Bucket:               &u.Host,
+		Key:                  &u.Path,
+		CopySource:           &src,
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             aws.StringMap(m.user()),
+		ContentType:          s3str(m.ContentType),
+		ContentEncoding:      s3str(m.ContentEncoding),
+		ContentDisposition:   s3str(m.ContentDisposition),
+		ContentLanguage:      s3str(m.ContentLanguage),
+		CacheControl:         s3str(m.CacheControl),
+		TaggingDirective:     &directive,
+		Tagging:              m.tagging(),
+		StorageClass:         o.StorageClass,
+		ServerSideEncryption: o.ServerSideEncryption,
+		SSEKMSKeyId:          o.SSEKMSKeyId,
+	})
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		acl, grants := g.uploadACL(u.Host)
+		putACL(gc, u, acl, grants)
+		return nil
+	}
+	_, err = gc.PutObjectAcl(&s3.PutObjectAclInput{
+		Bucket:              &u.Host,
+		Key:                 &u.Path,
+		AccessControlPolicy: policy,
+	})
+	if err != nil {
+		// buckets enforcing the owner have no acls to restore
+		log.Debug.Add("action", "setmeta", "file", file, "err", err).Printf("acl not restored")
+	}
+	return nil
+}
+
+// ServerCopy copies src to dst, both in s3, with the metadata in m.
+// Objects larger than 5GiB can not be copied in one request, so they
+// are not.
+func (g *S3) ServerCopy(src, dst string, m Meta) error {
+	if !g.ensure() {
+		return g.err
+	}
+	sc, _ := g.regionize(src)
+	su, du := uri(src), uri(dst)
+	o, err := sc.HeadObject(&s3.HeadObjectInput{
+		Bucket: &su.Host,
+		Key:    &su.Path,
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(o.ContentLength) > 5<<30 {
+		return errNoServerCopy
+	}
+	directive := s3.TaggingDirectiveCopy
+	if len(m.Tags) > 0 {
+		directive = s3.TaggingDirectiveReplace
+	}
+	dc, _ := g.regionize(dst)
+	from := (&url.URL{Path: su.Host + "/" + strings.TrimPrefix(su.Path, "/")}).EscapedPath()
+	_, err = dc.CopyObject(&s3.CopyObjectInput{
+		Bucket:             &du.Host,
+		Key:                &du.Path,
+		CopySource:         &from,
+		MetadataDirective:  aws.String(s3.MetadataDirectiveReplace),
+		Metadata:           aws.StringMap(m.user()),
+		ContentType:        s3str(m.ContentType),
+		ContentEncoding:    s3str(m.ContentEncoding),
+		ContentDisposition: s3str(m.ContentDisposition),
+		ContentLanguage:    s3str(m.ContentLanguage),
+		CacheControl:       s3str(m.CacheControl),
+		TaggingDirective:   &directive,
+		Tagging:            m.tagging(),
+	})
+	if err == nil {
+		acl, grants := g.uploadACL(du.Host)
+		putACL(dc, du, acl, grants)
+	}
+	return err
+}
+
 type pipeline struct {
-	wait chan error
-	err  error
+	wait     chan error
+	err      error
+	partsize int64
+	abort    func() error
 	io.WriteCloser
 }
 
+// Abort stops the upload and aborts it
+func (p *pipeline) Abort() error {
+	err := p.abort()
+	p.Close()
+	return err
+}
+
+// Partsize returns the size of the parts uploaded by the pipeline
+func (p *pipeline) Partsize() int64 {
+	return p.partsize
+}
+
 func (p *pipeline) Write(b []byte) (int, error) {
 	n, err := p.WriteCloser.Write(b)
 	if err != nil {
@@ -224,12 +448,40 @@ func (g *S3) uploadGrants(bucket string) string {
 	return grants
 }
 
+// uploadACL returns the canned acl and full control grants for
+// new objects in bucket; only one of them is non-empty
+func (g *S3) uploadACL(bucket string) (string, string) {
+	grants := ""
+	if !*test {
+		grants = g.uploadGrants(bucket)
+	}
+	acl := *acl
+	if acl == "" {
+		acl = s3acl
+		if grants != "" {
+			acl = ""
+		}
+	} else {
+		grants = ""
+	}
+	return acl, grants
+}
+
 func (g *S3) Create(file string) (io.WriteCloser, error) {
+	return g.CreateMeta(file, Meta{})
+}
+
+// CreateMeta is Create with the object headers and user metadata in m
+func (g *S3) CreateMeta(file string, m Meta) (io.WriteCloser, error) {
 	if !g.ensure() {
 		return nil, g.err
 	}
 	gc, gu := g.regionize(file)
 	u := uri(file)
+	acl, grants := g.uploadACL(u.Host)
+	if *resumable {
+		return &multipart{c: gc, u: u, acl: acl, grants: grants, dst: file, meta: m}, nil
+	}
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return nil, err
@@ -237,46 +489,62 @@ func (g *S3) Create(file string) (io.WriteCloser, error) {
 
 	pipectl := &pipeline{
 		wait:        make(chan error, 1),
+		partsize:    gu.PartSize,
 		WriteCloser: pw,
 	}
 
-	grants := ""
-	if !*test {
-		grants = g.uploadGrants(u.Host)
-	}
-	acl := *acl
-	if acl == "" {
-		acl = s3acl
-		if grants != "" {
-			acl = ""
-		}
-	} else {
-		grants = ""
+	uctx, cancel := context.WithCancel(g.ctx)
+	failed := make(chan string, 1) // the id of the upload, if it failed
+	var (
+		once     sync.Once
+		aborterr error
+	)
+	pipectl.abort = func() error {
+		once.Do(func() {
+			cancel()
+			pr.Close() // the uploader may be waiting for data
+			select {
+			case id := <-failed:
+				if id != "" {
+					aborterr = abortUpload(gc, u, id)
+				}
+			case <-time.After(time.Minute):
+				aborterr = errors.New("s3: uploader did not stop")
+			}
+		})
+		return aborterr
 	}
-
+	up := track(file, pipectl.abort)
 	go func() {
 		atomic.AddInt64(&g.ctr, +1)
 		defer atomic.AddInt64(&g.ctr, -1)
+		defer up.untrack()
 		br := bufio.NewReader(pr)
-		data, _ := br.Peek(32)
-		content := sniffContent(data)
-		_, err = gu.Upload(&s3m.UploadInput{
-			Body:        br,
-			Bucket:      &u.Host,
-			Key:         &u.Path,
-			ContentType: &content,
+		data, _ := br.Peek(sniffLen)
+		content := m.contentType(u.Path, data)
+		_, err = gu.UploadWithContext(uctx, &s3m.UploadInput{
+			Body:               br,
+			Bucket:             &u.Host,
+			Key:                &u.Path,
+			ContentType:        &content,
+			CacheControl:       s3str(m.CacheControl),
+			ContentEncoding:    s3str(m.ContentEncoding),
+			ContentDisposition: s3str(m.ContentDisposition),
+			ContentLanguage:    s3str(m.ContentLanguage),
+			Metadata:           aws.StringMap(m.user()),
+			Tagging:            m.tagging(),
 		})
 		if err == nil {
-			_, err := gc.PutObjectAcl(&s3.PutObjectAclInput{
-				Key:              &u.Path,
-				Bucket:           &u.Host,
-				ACL:              &acl,
-				GrantFullControl: &grants,
-			})
-			if err != nil {
-				log.Warn.F("s3: failed to grant full control: %s", err)
-			}
+			putACL(gc, u, acl, grants)
 		}
+		// the uploader leaves a failed upload to be aborted when it
+		// was cancelled
+		id := ""
+		var mf s3m.MultiUploadFailure
+		if errors.As(err, &mf) {
+			id = mf.UploadID()
+		}
+		failed <- id
 		pipectl.wait <- err
 		if err != nil {
 			pipectl.Close()
@@ -285,6 +553,84 @@ func (g *S3) Create(file string) (io.WriteCloser, error) {
 	return pipectl, nil
 }
 
+// tagging returns the tags in m in the format of the x-amz-tagging
+// header, or nil
+func (m Meta) tagging() *string {
+	v := url.Values{}
+	for k, t := range m.Tags {
+		v.Set(k, t)
+	}
+	return s3str(v.Encode())
+}
+
+// s3str returns nil for an empty string, so the header is not sent
+func s3str(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func putACL(gc *s3.S3, u url.URL, acl, grants string) {
+	_, err := gc.PutObjectAcl(&s3.PutObjectAclInput{
+		Key:              &u.Path,
+		Bucket:           &u.Host,
+		ACL:              &acl,
+		GrantFullControl: &grants,
+	})
+	if err != nil {
+		log.Warn.F("s3: failed to grant full control: %s", err)
+	}
+}
+
+// Uploads lists the incomplete multipart uploads under dir
+func (g *S3) Uploads(dir string) (list []Upload, err error) {
+	if !g.ensure() {
+		return nil, g.err
+	}
+	gc, _ := g.regionize(dir)
+	u := uri(dir)
+	dir = strings.TrimPrefix(u.Path, "/")
+	err = gc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: &u.Host,
+		Prefix: &dir,
+	}, func(o *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, v := range o.Uploads {
+			u := u
+			u.Path = *v.Key
+			list = append(list, Upload{URL: &u, ID: *v.UploadId, Initiated: *v.Initiated})
+		}
+		return true
+	})
+	return list, err
+}
+
+// Abort aborts an incomplete multipart upload
+func (g *S3) Abort(up Upload) error {
+	if !g.ensure() {
+		return g.err
+	}
+	gc, _ := g.regionize(up.String())
+	key := strings.TrimPrefix(up.Path, "/")
+	_, err := gc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &up.Host,
+		Key:      &key,
+		UploadId: &up.ID,
+	})
+	return err
+}
+
+// abortUpload aborts the multipart upload id of u
+func abortUpload(gc *s3.S3, u url.URL, id string) error {
+	key := strings.TrimPrefix(u.Path, "/")
+	_, err := gc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &u.Host,
+		Key:      &key,
+		UploadId: &id,
+	})
+	return err
+}
+
 func (g *S3) Close() error {
 	for atomic.LoadInt64(&g.ctr) > 0 {
 		log.Printf("s3: %d uploaders uploading", atomic.LoadInt64(&g.ctr))
@@ -329,3 +675,245 @@ func awsRegion() string {
 }
 
 const idURL = "http://169.254.169.254/latest/dynamic/instance-identity/document"
+
+// multipart is a resumable s3 upload. Its progress is persisted
+// with upstate after every part, so a later process writing the
+// same destination from the same source can continue it.
+type multipart struct {
+	c           *s3.S3
+	u           url.URL
+	dst         string
+	acl, grants string
+	meta        Meta
+
+	st   *upstate
+	up   *inflight
+	buf  []byte
+	next int64 // next part number
+	wg   sync.WaitGroup
+	sema chan bool
+
+	mu  sync.Mutex
+	err error
+}
+
+func (m *multipart) init() {
+	if m.st == nil {
+		m.st = &upstate{Dst: m.dst, file: statefile(m.dst), PartSize: resumePartsize(0)}
+	}
+	if m.sema == nil {
+		// the parts in flight, like the uploader's concurrency;
+		// upsema lowers it when throttled
+		m.sema = make(chan bool, maxupload)
+	}
+	if m.next == 0 {
+		m.next = 1
+	}
+}
+
+func (m *multipart) Resume(fp string, size int) (int64, error) {
+	st := loadState(m.dst)
+	m.st = &upstate{Dst: m.dst, file: st.file, Fingerprint: fp, PartSize: resumePartsize(size)}
+	m.init()
+	if st.UploadID == "" {
+		return 0, nil
+	}
+	if fp == "" {
+		// the source can not be matched to the earlier attempt
+		m.abort(st.UploadID)
+		st.done()
+		return 0, nil
+	}
+	if st.Fingerprint != fp {
+		log.Warn.Add("dst", m.dst).Printf("s3: source changed since last upload attempt, starting over")
+		m.abort(st.UploadID)
+		st.done()
+		return 0, nil
+	}
+	parts := []uppart{}
+	err := m.c.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   &m.u.Host,
+		Key:      &m.u.Path,
+		UploadId: &st.UploadID,
+	}, func(o *s3.ListPartsOutput, last bool) bool {
+		for _, p := range o.Parts {
+			parts = append(parts, uppart{N: *p.PartNumber, ETag: *p.ETag, Size: *p.Size})
+		}
+		return true
+	})
+	if err != nil {
+		log.Warn.Add("dst", m.dst, "err", err).Printf("s3: can not list parts of previous upload, starting over")
+		m.abort(st.UploadID)
+		st.done()
+		return 0, nil
+	}
+	m.st.UploadID = st.UploadID
+	m.up = track(m.dst, nil)
+	m.st.PartSize = st.PartSize
+	m.st.Parts = parts
+	m.st.Parts = m.st.contiguous()
+	m.next = int64(len(m.st.Parts)) + 1
+	return int64(len(m.st.Parts)) * m.st.PartSize, nil
+}
+
+// Partsize returns the size of the parts uploaded by m
+func (m *multipart) Partsize() int64 {
+	m.init()
+	return m.st.PartSize
+}
+
+func (m *multipart) Write(p []byte) (n int, err error) {
+	m.init()
+	if err = m.Err(); err != nil {
+		return 0, err
+	}
+	for len(p) > 0 {
+		k := int(m.st.PartSize) - len(m.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+		m.buf = append(m.buf, p[:k]...)
+		p = p[k:]
+		n += k
+		if len(m.buf) == int(m.st.PartSize) {
+			if err = m.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered part in the background
+func (m *multipart) flush() error {
+	if m.st.UploadID == "" {
+		content := m.meta.contentType(m.u.Path, m.buf)
+		o, err := m.c.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:             &m.u.Host,
+			Key:                &m.u.Path,
+			ContentType:        &content,
+			CacheControl:       s3str(m.meta.CacheControl),
+			ContentEncoding:    s3str(m.meta.ContentEncoding),
+			ContentDisposition: s3str(m.meta.ContentDisposition),
+			ContentLanguage:    s3str(m.meta.ContentLanguage),
+			Metadata:           aws.StringMap(m.meta.user()),
+			Tagging:            m.meta.tagging(),
+		})
+		if err != nil {
+			m.fail(err)
+			return err
+		}
+		m.up = track(m.dst, nil)
+		m.st.Lock()
+		m.st.UploadID = *o.UploadId
+		err = m.st.save()
+		m.st.Unlock()
+		if err != nil {
+			log.Warn.Add("dst", m.dst, "err", err).Printf("s3: upload will not be resumable")
+		}
+	}
+	data, n := m.buf, m.next
+	m.buf, m.next = nil, m.next+1
+	m.sema <- true
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() { <-m.sema }()
+		upsema.acquire()
+		defer upsema.release()
+		o, err := m.c.UploadPart(&s3.UploadPartInput{
+			Bucket:     &m.u.Host,
+			Key:        &m.u.Path,
+			UploadId:   &m.st.UploadID,
+			PartNumber: &n,
+			Body:       bytes.NewReader(data),
+		})
+		if err != nil {
+			m.fail(fmt.Errorf("s3: upload part %d: %w", n, err))
+			return
+		}
+		m.st.add(uppart{N: n, ETag: *o.ETag, Size: int64(len(data))})
+	}()
+	return m.Err()
+}
+
+func (m *multipart) fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.mu.Unlock()
+}
+
+func (m *multipart) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *multipart) Close() error {
+	m.init()
+	if m.st.UploadID == "" {
+		// never reached a full part, so there is nothing to resume
+		content := m.meta.contentType(m.u.Path, m.buf)
+		_, err := m.c.PutObject(&s3.PutObjectInput{
+			Bucket:             &m.u.Host,
+			Key:                &m.u.Path,
+			ContentType:        &content,
+			CacheControl:       s3str(m.meta.CacheControl),
+			ContentEncoding:    s3str(m.meta.ContentEncoding),
+			ContentDisposition: s3str(m.meta.ContentDisposition),
+			ContentLanguage:    s3str(m.meta.ContentLanguage),
+			Metadata:           aws.StringMap(m.meta.user()),
+			Tagging:            m.meta.tagging(),
+			Body:               bytes.NewReader(m.buf),
+		})
+		if err == nil {
+			putACL(m.c, m.u, m.acl, m.grants)
+			m.st.done()
+		}
+		return err
+	}
+	if len(m.buf) > 0 {
+		m.flush()
+	}
+	m.wg.Wait()
+	if err := m.Err(); err != nil {
+		return err
+	}
+	parts := []*s3.CompletedPart{}
+	for _, p := range m.st.Parts {
+		p := p
+		parts = append(parts, &s3.CompletedPart{PartNumber: &p.N, ETag: &p.ETag})
+	}
+	_, err := m.c.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &m.u.Host,
+		Key:             &m.u.Path,
+		UploadId:        &m.st.UploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return fmt.Errorf("s3: complete multipart upload: %w", err)
+	}
+	putACL(m.c, m.u, m.acl, m.grants)
+	m.st.done()
+	m.up.untrack()
+	return nil
+}
+
+// Abort waits for the parts being uploaded and leaves the upload
+// incomplete, so it can be resumed
+func (m *multipart) Abort() error {
+	m.init()
+	m.wg.Wait()
+	return nil
+}
+
+func (m *multipart) abort(id string) error {
+	_, err := m.c.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &m.u.Host,
+		Key:      &m.u.Path,
+		UploadId: &id,
+	})
+	return err
+}
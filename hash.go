@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+func newCRC32C() hash.Hash { return crc32.New(castagnoli) }
+
+// hashlist parses a comma separated list of hash names
+func hashlist(names string) ([]string, error) {
+	list := []string{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if hashes[name] == nil {
+			return nil, fmt.Errorf("hash: unsupported: %s", name)
+		}
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+// multihash computes several digests in one pass
+type multihash struct {
+	name []string
+	h    []hash.Hash
+}
+
+func newMultihash(name ...string) *multihash {
+	m := &multihash{name: name}
+	for _, name := range name {
+		m.h = append(m.h, hashes[name]())
+	}
+	return m
+}
+
+func (m *multihash) Write(p []byte) (int, error) {
+	for _, h := range m.h {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the hex digests in the order of the names
+func (m *multihash) sums() []string {
+	s := make([]string, len(m.h))
+	for i, h := range m.h {
+		s[i] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	return s
+}
+
+// String returns the digest alone if there is one hash, otherwise a
+// comma separated list of name:digest
+func (m *multihash) String() string {
+	s := m.sums()
+	if len(s) == 1 {
+		return s[0]
+	}
+	for i := range s {
+		s[i] = m.name[i] + ":" + s[i]
+	}
+	return strings.Join(s, ",")
+}
+
+// sumof returns the digest of the named hash in a string made by
+// multihash.String
+func sumof(sum, name string) string {
+	if !strings.Contains(sum, ":") {
+		return sum
+	}
+	for _, s := range strings.Split(sum, ",") {
+		if k, v, _ := strings.Cut(s, ":"); k == name {
+			return v
+		}
+	}
+	return ""
+}
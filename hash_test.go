@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHashes(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"blake2b", "abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"xxhash", "abc", "44bc2cf5ad770999"},
+		{"crc32c", "abc", "364b3fb7"},
+		{"sha384", "abc", "cb00753f45a35e8bb5a03d699ac65007272c32ab0eded1631a8b605a43ff5bed8086072ba1e7cc2358baeca134c825a7"},
+	} {
+		h := hashes[tc.name]()
+		// split the input to exercise the buffering
+		for _, s := range strings.SplitAfter(tc.in, "s") {
+			h.Write([]byte(s))
+		}
+		if have := fmt.Sprintf("%x", h.Sum(nil)); have != tc.want {
+			t.Errorf("%s(%q): have %s want %s", tc.name, tc.in, have, tc.want)
+		}
+	}
+	for name := range hashes {
+		if hashtags[name] == "" {
+			t.Errorf("%s: no tag for checksum lines", name)
+		}
+	}
+}
+
+func TestMultihash(t *testing.T) {
+	m := newMultihash("crc32c", "xxhash")
+	m.Write([]byte("abc"))
+	sum := m.String()
+	if sum != "crc32c:364b3fb7,xxhash:44bc2cf5ad770999" {
+		t.Fatalf("have %q", sum)
+	}
+	if have := sumof(sum, "xxhash"); have != "44bc2cf5ad770999" {
+		t.Fatalf("sumof: have %q", have)
+	}
+	if have := sumof("364b3fb7", "crc32c"); have != "364b3fb7" {
+		t.Fatalf("sumof single: have %q", have)
+	}
+}
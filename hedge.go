@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/as/log"
+)
+
+// race tracks the download of one block so stragglers can be hedged.
+// A hedge fetches the rest of the block on a fresh connection into
+// temporary storage. Whichever copy finishes first wins and cancels
+// the other. If the hedge wins, the block worker splices the tail
+// of the hedged data into the block, so the block is only ever
+// written by its worker.
+type race struct {
+	sync.Mutex
+	sp, ep int
+	start  time.Time
+	end    time.Time
+	n      int64 // bytes written to the block
+
+	cancel context.CancelFunc // cancels the primary
+	stop   context.CancelFunc // cancels the hedge
+	hedged bool
+	won    bool  // the hedge finished first
+	off    int64 // block offset where the hedged data begins
+	tail   Store // the hedged data
+}
+
+func (r *race) Write(p []byte) (int, error) {
+	atomic.AddInt64(&r.n, int64(len(p)))
+	return len(p), nil
+}
+
+func (r *race) running() bool {
+	r.Lock()
+	defer r.Unlock()
+	return !r.start.IsZero() && r.end.IsZero()
+}
+
+// rate returns the throughput of the block in bytes per second,
+// how long it has been running, and how many bytes are left
+func (r *race) rate(now time.Time) (float64, time.Duration, int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.start.IsZero() {
+		return 0, 0, 0
+	}
+	if !r.end.IsZero() {
+		now = r.end
+	}
+	n := atomic.LoadInt64(&r.n)
+	dur := now.Sub(r.start)
+	if dur <= 0 {
+		return 0, 0, 0
+	}
+	return float64(n) / dur.Seconds(), dur, r.ep - r.sp - int(n)
+}
+
+// begin marks the start of the primary download of [sp, ep)
+func (r *race) begin(sp, ep int) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Lock()
+	r.sp, r.ep, r.start, r.cancel = sp, ep, time.Now(), cancel
+	r.Unlock()
+	return ctx
+}
+
+// over marks the end of the primary download and cancels
+// a hedge that has not finished yet
+func (r *race) over() {
+	r.Lock()
+	defer r.Unlock()
+	if r.end.IsZero() {
+		r.end = time.Now()
+	}
+	if !r.won && r.stop != nil {
+		r.stop()
+	}
+}
+
+func (r *race) ended() bool {
+	r.Lock()
+	defer r.Unlock()
+	return !r.end.IsZero()
+}
+
+// finish is called by the block worker when the primary download
+// ends; it reports whether the hedge won
+func (r *race) finish() bool {
+	r.over()
+	r.Lock()
+	defer r.Unlock()
+	return r.won
+}
+
+// splice copies the hedged data after the first written bytes
+// into the block
+func (r *race) splice(dst io.Writer, written int64) (int64, error) {
+	defer r.tail.Close()
+	if written < r.off {
+		return 0, fmt.Errorf("hedge: block has %d bytes, hedge starts at %d", written, r.off)
+	}
+	size := int64(r.ep-r.sp) - written
+	return io.Copy(dst, io.NewSectionReader(r.tail, written-r.off, size))
+}
+
+// hedgeClient never reuses connections (see inittransport)
+var hedgeClient = &http.Client{}
+
+var (
+	// hedgeAge is how long a block runs before it can be hedged,
+	// and hedgeTail how much of it must be left
+	hedgeAge  = 3 * time.Second
+	hedgeTail = 1024 * 1024
+
+	// hedgeTick is how often the blocks are checked
+	hedgeTick = time.Second
+)
+
+// hedgeMonitor watches the running blocks and hedges the ones whose
+// throughput falls below the median by more than -hedge times
+func (f *File) hedgeMonitor() {
+	defer f.wg.Done()
+	if *hedge <= 0 {
+		return
+	}
+	tick := time.NewTicker(hedgeTick)
+	defer tick.Stop()
+	for range tick.C {
+		now, rates, active := time.Now(), []float64{}, 0
+		for _, r := range f.race {
+			// finished blocks always count, running ones only
+			// after they had time to ramp up
+			rate, dur, _ := r.rate(now)
+			running := r.running()
+			if running {
+				active++
+			}
+			if dur == 0 || (running && dur < hedgeAge) {
+				continue
+			}
+			rates = append(rates, rate)
+		}
+		if active == 0 && f.ended() {
+			return
+		}
+		if len(rates) < 3 || atomic.LoadInt32(&f.nohedge) != 0 {
+			continue
+		}
+		sort.Float64s(rates)
+		median := rates[len(rates)/2]
+		for block, r := range f.race {
+			rate, dur, tail := r.rate(now)
+			if dur < hedgeAge || !r.running() || tail < hedgeTail || rate*(*hedge) >= median {
+				continue
+			}
+			r.Lock()
+			if !r.hedged {
+				r.hedged = true
+				log.Warn.Add("action", "hedge", "block", block, "mbps", rate/1024/1024, "median", median/1024/1024).Printf("hedging straggler block")
+				f.wg.Add(1)
+				go f.hedgeBlock(block, r)
+			}
+			r.Unlock()
+		}
+	}
+}
+
+func (f *File) ended() bool {
+	for _, r := range f.race {
+		if !r.ended() {
+			return false
+		}
+	}
+	return true
+}
+
+// hedgeBlock downloads the rest of the block on a fresh connection.
+// The hedge counts against -maxhttp like any block, and a throttled
+// hedge stops the hedging of the file: hedges would only add to the
+// load of a server that asks for less.
+func (f *File) hedgeBlock(block int, r *race) {
+	defer f.wg.Done()
+	if sema != nil {
+		sema.acquire()
+		defer sema.release()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Lock()
+	if !r.end.IsZero() {
+		// it finished while the hedge waited for a connection
+		r.Unlock()
+		cancel()
+		return
+	}
+	r.stop, r.off = cancel, atomic.LoadInt64(&r.n)
+	r.Unlock()
+	defer cancel()
+
+	size := int64(r.ep-r.sp) - r.off
+	tail := newstore(block, int(size), nil) // a hedge does not wait for space
+	m := f.src.pick(block + 1)
+	req, err := newHTTPRequest("GET", m.url, nil)
+	if err == nil {
+		req = req.WithContext(ctx)
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", r.sp+int(r.off), r.ep-1))
+		var resp *http.Response
+		resp, err = hedgeClient.Do(req)
+		if err == nil {
+			if err = throttled(resp); err != nil {
+				atomic.StoreInt32(&f.nohedge, 1)
+				if sema != nil {
+					after, _ := isThrottle(err)
+					sema.throttle(after)
+				}
+			} else if resp.StatusCode != http.StatusPartialContent {
+				err = fmt.Errorf("http: %s", resp.Status)
+			} else if err = tail.Init(); err == nil {
+				if sema != nil {
+					sema.ok()
+				}
+				var n int64
+				n, err = io.Copy(tail, rxlimit(io.LimitReader(resp.Body, size), m.url))
+				if err == nil && n != size {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			resp.Body.Close()
+		}
+	}
+	tail.Fin()
+	line := log.Info.Add("action", "hedge", "block", block)
+	r.Lock()
+	if err != nil || !r.end.IsZero() {
+		r.Unlock()
+		tail.Close()
+		line.Add("err", err).Printf("hedge lost")
+		return
+	}
+	r.won, r.tail = true, tail
+	r.cancel()
+	r.Unlock()
+	line.Printf("hedge won")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallserver serves data in blocks of bs bytes. The first request
+// for block stall sends a little and then stalls until the client
+// gives up or for wait. The later requests for it, the hedges, are
+// answered with hedgestatus, if set.
+type stallserver struct {
+	data        []byte
+	bs, stall   int
+	wait        time.Duration
+	hedgestatus int
+
+	mu              sync.Mutex
+	stalled         bool
+	hedges          int
+	inflight, peak  int
+	primary, hedged int64 // bytes sent for the stalled block
+}
+
+func (s *stallserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.inflight++; s.inflight > s.peak {
+		s.peak = s.inflight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+	}()
+
+	sp, ep := 0, len(s.data)-1
+	if rng := r.Header.Get("Range"); rng != "" {
+		fmt.Sscanf(rng, "bytes=%d-%d", &sp, &ep)
+	}
+	s.mu.Lock()
+	// every request for the stalled block after the first is a hedge
+	inblock := sp >= s.stall*s.bs && sp < (s.stall+1)*s.bs && r.Header.Get("Range") != ""
+	hedge := inblock && s.stalled
+	stall := inblock && !s.stalled
+	if stall {
+		s.stalled = true
+	}
+	if hedge {
+		s.hedges++
+	}
+	s.mu.Unlock()
+	if hedge && s.hedgestatus != 0 {
+		w.WriteHeader(s.hedgestatus)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", sp, ep, len(s.data)))
+	w.Header().Set("Content-Length", strconv.Itoa(ep-sp+1))
+	w.WriteHeader(http.StatusPartialContent)
+	body := s.data[sp : ep+1]
+	if stall {
+		w.Write(body[:64*1024])
+		w.(http.Flusher).Flush()
+		atomic.AddInt64(&s.primary, 64*1024)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(s.wait):
+		}
+		body = body[64*1024:]
+		atomic.AddInt64(&s.primary, int64(len(body)))
+	} else if hedge {
+		atomic.AddInt64(&s.hedged, int64(len(body)))
+	}
+	w.Write(body)
+}
+
+// hedged downloads s with hedging tuned for a test
+func hedged(t *testing.T, s *stallserver) (*File, []byte) {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	defer func(a time.Duration, n int, tick time.Duration) { hedgeAge, hedgeTail, hedgeTick = a, n, tick }(hedgeAge, hedgeTail, hedgeTick)
+	defer func(ps int, ns bool, h float64, sm *aimd) { *partsize, *nosort, *hedge, sema = ps, ns, h, sm }(*partsize, *nosort, *hedge, sema)
+	hedgeAge, hedgeTail, hedgeTick = 100*time.Millisecond, 0, 20*time.Millisecond
+	*partsize, *nosort, *hedge, sema = s.bs, true, 5, newAIMD("http", 2)
+
+	f := &File{}
+	if err := f.Download(srv.URL + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.wg.Wait()
+	return f, have
+}
+
+func TestHedgeStraggler(t *testing.T) {
+	data := make([]byte, 4<<20)
+	mrand.New(mrand.NewSource(1)).Read(data)
+	s := &stallserver{data: data, bs: 1 << 20, stall: 2, wait: time.Minute}
+	f, have := hedged(t, s)
+	if !bytes.Equal(have, data) {
+		t.Fatalf("have %d bytes, want the %d of the source", len(have), len(data))
+	}
+	if s.hedges != 1 || !f.race[2].won {
+		t.Fatalf("have %d hedges (won=%v), want the one that won", s.hedges, f.race[2].won)
+	}
+	// the straggler was cancelled, so the block was written once:
+	// its first bytes by the primary and the rest by the hedge
+	if p, h := atomic.LoadInt64(&s.primary), atomic.LoadInt64(&s.hedged); p+h != int64(s.bs) {
+		t.Fatalf("primary sent %d and hedge %d bytes, want %d in total", p, h, s.bs)
+	}
+	// block 0 does not wait for a connection, the rest share two
+	if s.peak > 3 {
+		t.Fatalf("%d requests at once, want at most 3", s.peak)
+	}
+}
+
+func TestHedgeThrottled(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789abcdef", 4<<20/16))
+	s := &stallserver{data: data, bs: 1 << 20, stall: 2, wait: time.Second, hedgestatus: http.StatusTooManyRequests}
+	f, have := hedged(t, s)
+	if !bytes.Equal(have, data) {
+		t.Fatalf("have %d bytes, want the %d of the source", len(have), len(data))
+	}
+	if s.hedges != 1 || f.race[2].won {
+		t.Fatalf("have %d hedges (won=%v), want one that lost", s.hedges, f.race[2].won)
+	}
+	if atomic.LoadInt32(&f.nohedge) == 0 {
+		t.Fatal("throttled hedge did not stop the hedging")
+	}
+}
@@ -0,0 +1,51 @@
+package blake2b
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVectors(t *testing.T) {
+	long := make([]byte, 1024)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce"},
+		// rfc 7693, appendix a
+		{"abc", "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{"The quick brown fox jumps over the lazy dog", "a8add4bdddfd93e4877d2746e62817b116364a1fa7bc148d95090bc7333b3673f82401cf7aa2e4cb1ecd90296e3f14cb5413f8ed77be73045b13914cdcd6a918"},
+		// eight full blocks, the last one compressed by Sum (python hashlib)
+		{string(long), "6b490f42e902f61b1ee12d3c85e34152e37c94d07ab9ea577cad6a6eb4690fad38064f53a19c225703a5c52cdc9a85add71b339d327e1630ee3432b920240e8a"},
+	} {
+		h := New512()
+		h.Write([]byte(tc.in))
+		if have := fmt.Sprintf("%x", h.Sum(nil)); have != tc.want {
+			t.Errorf("%.16q: have %s want %s", tc.in, have, tc.want)
+		}
+	}
+}
+
+func TestWrites(t *testing.T) {
+	in := strings.Repeat("0123456789", 100)
+	h := New512()
+	h.Write([]byte(in))
+	want := h.Sum(nil)
+	for _, n := range []int{1, 7, 127, 128, 129} {
+		h.Reset()
+		for p := []byte(in); len(p) > 0; {
+			k := n
+			if k > len(p) {
+				k = len(p)
+			}
+			h.Write(p[:k])
+			p = p[k:]
+		}
+		if have := h.Sum(nil); string(have) != string(want) {
+			t.Errorf("writes of %d: have %x want %x", n, have, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package xxh64 implements XXH64 with a zero seed. The digest is
+// big-endian, as printed by xxhsum.
+package xxh64
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// Size is the length of the digest in bytes
+const Size = 8
+
+// BlockSize is the stripe size of the hash in bytes
+const BlockSize = 32
+
+type digest struct {
+	v   [4]uint64
+	n   uint64
+	buf [BlockSize]byte
+	k   int
+}
+
+const (
+	p1 uint64 = 0x9e3779b185ebca87
+	p2 uint64 = 0xc2b2ae3d27d4eb4f
+	p3 uint64 = 0x165667b19e3779f9
+	p4 uint64 = 0x85ebca77c2b2ae63
+	p5 uint64 = 0x27d4eb2f165667c5
+)
+
+// New returns a new hash computing the XXH64 digest
+func New() hash.Hash {
+	x := &digest{}
+	x.Reset()
+	return x
+}
+
+func (x *digest) Size() int      { return Size }
+func (x *digest) BlockSize() int { return BlockSize }
+
+func (x *digest) Reset() {
+	a, b := p1, p2 // the sums wrap around
+	x.v = [4]uint64{a + b, b, 0, -a}
+	x.n, x.k = 0, 0
+}
+
+func round(acc, in uint64) uint64 {
+	return bits.RotateLeft64(acc+in*p2, 31) * p1
+}
+
+func merge(acc, v uint64) uint64 {
+	return (acc^round(0, v))*p1 + p4
+}
+
+func (x *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	x.n += uint64(n)
+	for len(p) > 0 {
+		k := copy(x.buf[x.k:], p)
+		x.k += k
+		p = p[k:]
+		if x.k == len(x.buf) {
+			for i := range x.v {
+				x.v[i] = round(x.v[i], binary.LittleEndian.Uint64(x.buf[i*8:]))
+			}
+			x.k = 0
+		}
+	}
+	return n, nil
+}
+
+func (x *digest) Sum(in []byte) []byte {
+	var h uint64
+	if x.n >= 32 {
+		v := x.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, v := range v {
+			h = merge(h, v)
+		}
+	} else {
+		h = p5
+	}
+	h += x.n
+	p := x.buf[:x.k]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*p1 + p4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * p1
+		h = bits.RotateLeft64(h, 23)*p2 + p3
+		p = p[4:]
+	}
+	for _, c := range p {
+		h ^= uint64(c) * p5
+		h = bits.RotateLeft64(h, 11) * p1
+	}
+	h ^= h >> 33
+	h *= p2
+	h ^= h >> 29
+	h *= p3
+	h ^= h >> 32
+	return binary.BigEndian.AppendUint64(in, h)
+}
@@ -0,0 +1,45 @@
+package xxh64
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVectors(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", "ef46db3751d8e999"},
+		{"abc", "44bc2cf5ad770999"},
+		// longer than a stripe (python-xxhash readme)
+		{"Nobody inspects the spammish repetition", "fbcea83c8a378bf1"},
+	} {
+		h := New()
+		h.Write([]byte(tc.in))
+		if have := fmt.Sprintf("%x", h.Sum(nil)); have != tc.want {
+			t.Errorf("%q: have %s want %s", tc.in, have, tc.want)
+		}
+	}
+}
+
+func TestWrites(t *testing.T) {
+	in := strings.Repeat("0123456789", 100)
+	h := New()
+	h.Write([]byte(in))
+	want := h.Sum(nil)
+	for _, n := range []int{1, 7, 31, 32, 33} {
+		h.Reset()
+		for p := []byte(in); len(p) > 0; {
+			k := n
+			if k > len(p) {
+				k = len(p)
+			}
+			h.Write(p[:k])
+			p = p[k:]
+		}
+		if have := h.Sum(nil); string(have) != string(want) {
+			t.Errorf("writes of %d: have %x want %x", n, have, want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket shared by every reader or writer it
+// limits. Callers take what they transferred and sleep off the debt,
+// so the bucket hands out bandwidth in the order it was asked for and
+// no single worker can starve the others. The bucket holds at most a
+// quarter second of tokens, so it does not burst after an idle period.
+type bucket struct {
+	sync.Mutex
+	sched  []window
+	tokens float64
+	last   time.Time
+}
+
+// window is a rate in bytes per second that applies between two
+// times of day; a window with from == to applies all day
+type window struct {
+	rate     float64
+	from, to time.Duration
+}
+
+func (w window) match(t time.Time) bool {
+	if w.from == w.to {
+		return true
+	}
+	y, m, d := t.Date()
+	now := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if w.from < w.to {
+		return now >= w.from && now < w.to
+	}
+	return now >= w.from || now < w.to // crosses midnight
+}
+
+// rate returns the rate at time t, zero means unlimited. Windows with
+// a time of day take precedence over the ones without.
+func (b *bucket) rate(t time.Time) float64 {
+	for _, w := range b.sched {
+		if w.from != w.to && w.match(t) {
+			return w.rate
+		}
+	}
+	for _, w := range b.sched {
+		if w.from == w.to {
+			return w.rate
+		}
+	}
+	return 0
+}
+
+// take removes n tokens and returns how long the caller must wait
+func (b *bucket) take(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	rate := b.rate(now)
+	if rate <= 0 {
+		b.last = time.Time{}
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = rate / 4
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > rate/4 {
+		b.tokens = rate / 4
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// chunk returns the largest transfer that should be made at once,
+// so a worker does not take a long stretch of bandwidth in one go
+func (b *bucket) chunk() int {
+	b.Lock()
+	defer b.Unlock()
+	if rate := int(b.rate(time.Now()) / 10); rate > 0 {
+		if rate < 16*1024 {
+			rate = 16 * 1024
+		}
+		return rate
+	}
+	return 0
+}
+
+// buckets is a set of buckets that all apply to one transfer
+type buckets []*bucket
+
+func (bs buckets) take(n int) {
+	max := time.Duration(0)
+	for _, b := range bs {
+		if d := b.take(n); d > max {
+			max = d
+		}
+	}
+	if max > 0 {
+		time.Sleep(max)
+	}
+}
+
+func (bs buckets) clip(p []byte) []byte {
+	for _, b := range bs {
+		if n := b.chunk(); n > 0 && len(p) > n {
+			p = p[:n]
+		}
+	}
+	return p
+}
+
+type limitr struct {
+	io.Reader
+	b buckets
+}
+
+func (r limitr) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(r.b.clip(p))
+	r.b.take(n)
+	return n, err
+}
+
+type limitw struct {
+	io.Writer
+	b buckets
+}
+
+func (w limitw) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		q := w.b.clip(p)
+		m, err := w.Writer.Write(q)
+		w.b.take(m)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// limits holds the buckets configured by -rxlimit, -txlimit,
+// -hostlimit and -dstlimit
+var limits = struct {
+	rx, tx    *bucket
+	host, dst map[string]*bucket
+}{}
+
+func initlimits() error {
+	var err error
+	if limits.rx, err = newBucket(*limitRX); err != nil {
+		return fmt.Errorf("rxlimit: %w", err)
+	}
+	if limits.tx, err = newBucket(*limitTX); err != nil {
+		return fmt.Errorf("txlimit: %w", err)
+	}
+	if limits.host, err = hostBuckets(hostlimit); err != nil {
+		return fmt.Errorf("hostlimit: %w", err)
+	}
+	if limits.dst, err = hostBuckets(dstlimit); err != nil {
+		return fmt.Errorf("dstlimit: %w", err)
+	}
+	return nil
+}
+
+func newBucket(spec string) (*bucket, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{sched: sched}, nil
+}
+
+func hostBuckets(list []string) (map[string]*bucket, error) {
+	m := map[string]*bucket{}
+	for _, kv := range list {
+		host, spec, ok := strings.Cut(kv, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("want host=rate: %q", kv)
+		}
+		b, err := newBucket(spec)
+		if err != nil {
+			return nil, err
+		}
+		if m[host] != nil {
+			// repeating a host adds to its schedule
+			b.sched = append(m[host].sched, b.sched...)
+		}
+		m[host] = b
+	}
+	return m, nil
+}
+
+// hostmatch reports whether the limit for key applies to host. A key
+// matches its subdomains, and a bucket name matches its virtual-hosted
+// endpoint (e.g., the signed url of an accelerated download).
+func hostmatch(key, host string) bool {
+	return host == key || strings.HasSuffix(host, "."+key) || strings.HasPrefix(host, key+".")
+}
+
+func (bs buckets) add(global *bucket, m map[string]*bucket, file string) buckets {
+	if global != nil {
+		bs = append(bs, global)
+	}
+	u := uri(file)
+	for key, b := range m {
+		if u.Host != "" && (hostmatch(key, u.Host) || hostmatch(key, u.Hostname())) {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+// rxlimit limits the rate at which r, the data of file, is received
+func rxlimit(r io.Reader, file string) io.Reader {
+	if _, ok := r.(interface{ limited() }); ok {
+		// already limited where it comes off the network
+		return r
+	}
+	bs := buckets{}.add(limits.rx, limits.host, file)
+	if len(bs) == 0 {
+		return r
+	}
+	return limitr{r, bs}
+}
+
+// txlimit limits the rate at which w, the data of file, is sent
+func txlimit(w io.Writer, file string) io.Writer {
+	bs := buckets{}.add(limits.tx, limits.dst, file)
+	if len(bs) == 0 {
+		return w
+	}
+	return limitw{w, bs}
+}
+
+// parseSchedule parses a comma separated list of rates. Each may be
+// followed by @HH:MM-HH:MM to apply only during that time of day.
+//
+//	250Mbit
+//	10MiB/s@09:00-17:00,1GiB/s
+func parseSchedule(s string) (sched []window, err error) {
+	for _, e := range strings.Split(s, ",") {
+		rate, span, ok := strings.Cut(strings.TrimSpace(e), "@")
+		w := window{}
+		if w.rate, err = parseRate(rate); err != nil {
+			return nil, err
+		}
+		if ok {
+			from, to, _ := strings.Cut(span, "-")
+			if w.from, err = clock(from); err != nil {
+				return nil, err
+			}
+			if w.to, err = clock(to); err != nil {
+				return nil, err
+			}
+			if w.from == w.to {
+				return nil, fmt.Errorf("empty time window: %q", span)
+			}
+		}
+		sched = append(sched, w)
+	}
+	return sched, nil
+}
+
+func clock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day: %q (want HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// units are the suffixes understood by parseRate. Bits use decimal
+// prefixes (like network links), bytes use binary prefixes unless
+// spelled out as kB, MB or GB.
+var units = []struct {
+	suffix string
+	n      float64
+}{
+	{"kbit", 1e3 / 8}, {"mbit", 1e6 / 8}, {"gbit", 1e9 / 8}, {"bit", 1.0 / 8},
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1e3}, {"mb", 1e6}, {"gb", 1e9},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"b", 1},
+}
+
+// parseRate parses a rate like 250Mbit, 100Mbps, 1.5GiB/s or 800k
+// into bytes per second. A plain number is in MiB/s; zero means
+// unlimited.
+func parseRate(s string) (float64, error) {
+	num := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	if strings.HasSuffix(num, "bps") {
+		num = strings.TrimSuffix(num, "ps") + "it"
+	}
+	scale := float64(1 << 20)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = num[:len(num)-len(u.suffix)], u.n
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate: %q", s)
+	}
+	return n * scale, nil
+}
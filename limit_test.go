@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want float64
+	}{
+		{"20", 20 << 20},
+		{"0.5", 1 << 19},
+		{"250Mbit", 250e6 / 8},
+		{"100Mbps", 100e6 / 8},
+		{"1.5GiB/s", 1.5 * (1 << 30)},
+		{"800k", 800 << 10},
+		{"10MB", 10e6},
+		{"512b", 512},
+		{"0", 0},
+	} {
+		have, err := parseRate(tc.in)
+		if err != nil || have != tc.want {
+			t.Errorf("%q: have %v, %v want %v", tc.in, have, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "fast", "-1", "5Q"} {
+		if _, err := parseRate(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	sched, err := parseSchedule("10MiB@09:00-17:00,1MiB@22:00-06:00,100MiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bucket{sched: sched}
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{12 * time.Hour, 10 << 20},
+		{17 * time.Hour, 100 << 20},
+		{23 * time.Hour, 1 << 20},
+		{3 * time.Hour, 1 << 20},
+		{7 * time.Hour, 100 << 20},
+	} {
+		if have := b.rate(day.Add(tc.at)); have != tc.want {
+			t.Errorf("%v: have %v want %v", tc.at, have, tc.want)
+		}
+	}
+	for _, in := range []string{"1MiB@9-17", "1MiB@09:00-09:00", "1MiB@09:00"} {
+		if _, err := parseSchedule(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
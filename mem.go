@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/as/log"
+)
+
+// mem is the global memory budget for in-memory blocks (see -maxmem)
+// and a pool of block buffers, keyed by capacity, so freed blocks are
+// recycled instead of reallocated. freed counts the times memory or
+// temporary space was freed, for the blocks waiting on spacec.
+var mem = struct {
+	sync.Mutex
+	used  int
+	freed int
+	pool  map[int]*sync.Pool
+}{pool: map[int]*sync.Pool{}}
+
+var spacec = sync.NewCond(&mem.Mutex)
+
+// reserve takes n bytes from the budget and reports whether
+// there was enough left
+func reserve(n int) bool {
+	mem.Lock()
+	defer mem.Unlock()
+	if mem.used+n > *maxmem {
+		return false
+	}
+	mem.used += n
+	return true
+}
+
+// overdraw is reserve for the block a reader is waiting for: it may
+// exceed the budget by n bytes, unless a block already does
+func overdraw(n int) bool {
+	mem.Lock()
+	defer mem.Unlock()
+	if mem.used+n > *maxmem && mem.used > *maxmem {
+		return false
+	}
+	mem.used += n
+	return true
+}
+
+func release(n int) {
+	mem.Lock()
+	mem.used -= n
+	mem.Unlock()
+	freed()
+}
+
+// freed wakes the blocks waiting for memory or temporary space
+func freed() {
+	mem.Lock()
+	mem.freed++
+	spacec.Broadcast()
+	mem.Unlock()
+}
+
+// waitspace waits until something is freed after the count gen
+func waitspace(gen int) {
+	mem.Lock()
+	for mem.freed == gen {
+		spacec.Wait()
+	}
+	mem.Unlock()
+}
+
+func freedcount() int {
+	mem.Lock()
+	defer mem.Unlock()
+	return mem.freed
+}
+
+func getbuf(n int) []byte {
+	mem.Lock()
+	p := mem.pool[n]
+	mem.Unlock()
+	if p != nil {
+		if b, _ := p.Get().(*[]byte); b != nil {
+			return (*b)[:0]
+		}
+	}
+	return make([]byte, 0, n)
+}
+
+func putbuf(b []byte) {
+	n := cap(b)
+	mem.Lock()
+	p := mem.pool[n]
+	if p == nil {
+		p = &sync.Pool{}
+		mem.pool[n] = p
+	}
+	mem.Unlock()
+	b = b[:0]
+	p.Put(&b)
+}
+
+// newstore returns storage for a block of the given size; want
+// reports whether the reader is waiting for it (see auto)
+func newstore(n, size int, want func() bool) Store {
+	return &auto{n: n, size: size, want: want}
+}
+
+// auto is a block that lives in memory while the budget allows and
+// spills to disk otherwise. The choice is made when the block starts
+// downloading, so memory freed by blocks that were already read can
+// be reused by later ones. When neither is left, the block waits for
+// blocks to be freed. The block the reader waits for may go over the
+// budget instead (see overdraw): the space can be held by the blocks
+// after it, which are not freed before it is read. Without want, the
+// block does not wait and Init fails with errTempFull.
+type auto struct {
+	Store
+	n, size int
+	want    func() bool
+	ready   int64
+}
+
+func (a *auto) Init() error {
+	err := a.place()
+	if err == nil {
+		err = a.Store.Init()
+	}
+	atomic.StoreInt64(&a.ready, 1)
+	return err
+}
+
+// placer is a block that can choose its storage before Init
+type placer interface {
+	place() error
+}
+
+// place chooses the storage of the block
+func (a *auto) place() error {
+	for a.Store == nil {
+		gen := freedcount()
+		if reserve(a.size) {
+			log.Debug.F("block %d: creating memory block", a.n)
+			a.Store = &Block{Data: getbuf(a.size), budget: a.size}
+			return nil
+		}
+		log.Debug.F("block %d: memory budget exhausted (maxmem=%d), creating disk block", a.n, *maxmem)
+		d, err := makedisk(a.n, a.size)
+		if err != nil {
+			return err
+		}
+		if err = d.place(); err == nil {
+			a.Store = d
+			return nil
+		}
+		if !errors.Is(err, errTempFull) || a.want == nil {
+			return err
+		}
+		if a.want() && overdraw(a.size) {
+			log.Warn.Add("block", a.n, "size", a.size, "tmpreserve", *tmpreserve).Printf("temporary space low, keeping the next block in memory")
+			a.Store = &Block{Data: getbuf(a.size), budget: a.size}
+			return nil
+		}
+		log.Debug.F("block %d: waiting for memory or temporary space", a.n)
+		waitspace(gen)
+	}
+	return nil
+}
+
+func (a *auto) Ready() bool {
+	return atomic.LoadInt64(&a.ready) != 0 && a.Store.Ready()
+}
+
+func (a *auto) Fin() {
+	if a.Store != nil {
+		a.Store.Fin()
+	}
+}
+
+func (a *auto) Close() error {
+	if a.Store == nil {
+		return nil
+	}
+	return a.Store.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestMemSpill(t *testing.T) {
+	defer func(t0 []string, r, m int) { temps, *tmpreserve, *maxmem = t0, r, m }(temps, *tmpreserve, *maxmem)
+	temps, *tmpreserve = []string{t.TempDir()}, 0
+	mem.Lock()
+	used := mem.used
+	*maxmem = used + 10 // room for one block
+	mem.Unlock()
+
+	a, b := newstore(0, 10, nil), newstore(1, 10, nil)
+	for _, s := range []Store{a, b} {
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := a.(*auto).Store.(*Block); !ok {
+		t.Fatalf("first block: have %T want memory", a.(*auto).Store)
+	}
+	if _, ok := b.(*auto).Store.(*Disk); !ok {
+		t.Fatalf("second block: have %T want disk", b.(*auto).Store)
+	}
+	b.Close()
+	a.Close()
+	mem.Lock()
+	after := mem.used
+	mem.Unlock()
+	if after != used {
+		t.Fatalf("budget: %d bytes used after close, want %d", after, used)
+	}
+
+	// the freed memory is for the next block
+	c := newstore(2, 10, nil)
+	defer c.Close()
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(*auto).Store.(*Block); !ok {
+		t.Fatalf("third block: have %T want memory", c.(*auto).Store)
+	}
+}
+
+func TestBufReuse(t *testing.T) {
+	// the pool may drop buffers (it always might under -race), so
+	// reuse is only expected once in a while
+	for i := 0; i < 20; i++ {
+		b := getbuf(12345)
+		if cap(b) != 12345 || len(b) != 0 {
+			t.Fatalf("getbuf: len %d cap %d", len(b), cap(b))
+		}
+		b = append(b, 1)
+		putbuf(b)
+		if c := getbuf(12345); len(c) == 0 && &c[:1][0] == &b[0] {
+			return
+		}
+	}
+	t.Fatal("released buffers are never reused")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/log"
+)
+
+// Meta is the metadata carried from the source of a copy to its
+// destination. Each driver maps it to its own fields:
+//
+//	s3     object headers and x-amz-meta-*
+//	gs     object attributes and metadata
+//	http   response headers, x-amz-meta-* and x-goog-meta-*
+//	file   mtime and user.* extended attributes (content type
+//	       in user.mime_type)
+//
+// The modification time is kept in the user metadata as "mtime"
+// where there is no other place for it.
+type Meta struct {
+	ContentType        string
+	CacheControl       string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	ModTime            time.Time
+	User               map[string]string
+	Tags               map[string]string // only from -tag
+}
+
+// mtimekey is the user metadata holding the modification time
+const mtimekey = "mtime"
+
+type metacreator interface {
+	CreateMeta(file string, m Meta) (io.WriteCloser, error)
+}
+
+// fields returns pointers to the standard fields by name
+func (m *Meta) fields() map[string]*string {
+	return map[string]*string{
+		"content-type":        &m.ContentType,
+		"cache-control":       &m.CacheControl,
+		"content-encoding":    &m.ContentEncoding,
+		"content-disposition": &m.ContentDisposition,
+		"content-language":    &m.ContentLanguage,
+	}
+}
+
+// set sets the named field; a name that is not a standard field or
+// mtime is a user metadata key
+func (m *Meta) set(name, value string) error {
+	name = strings.ToLower(name)
+	if p := m.fields()[name]; p != nil {
+		*p = value
+		return nil
+	}
+	if name == mtimekey {
+		t, err := parsetime(value)
+		if err != nil {
+			return fmt.Errorf("meta: mtime: %w", err)
+		}
+		m.ModTime = t
+		return nil
+	}
+	if m.User == nil {
+		m.User = map[string]string{}
+	}
+	m.User[name] = value
+	return nil
+}
+
+// drop clears the named field: a standard field, mtime, user (all
+// user metadata), all, or a user metadata key
+func (m *Meta) drop(name string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "":
+	case "all":
+		*m = Meta{}
+	case "user":
+		m.User = nil
+	case mtimekey:
+		m.ModTime = time.Time{}
+	default:
+		if p := m.fields()[name]; p != nil {
+			*p = ""
+		} else {
+			delete(m.User, name)
+		}
+	}
+}
+
+// parsetime parses an rfc 3339 time or unix seconds
+func parsetime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time: %q (want rfc 3339 or unix seconds)", s)
+	}
+	return time.Unix(0, int64(sec*1e9)), nil
+}
+
+// setUser sets the user metadata from a driver's map, taking the
+// modification time out of it. Keys are lowercase (s3 returns them
+// like http headers).
+func (m *Meta) setUser(user map[string]string, fallback time.Time) {
+	m.ModTime = fallback
+	for k, v := range user {
+		k = strings.ToLower(k)
+		if k == mtimekey {
+			if t, err := parsetime(v); err == nil {
+				m.ModTime = t
+				continue
+			}
+		}
+		if m.User == nil {
+			m.User = map[string]string{}
+		}
+		m.User[k] = v
+	}
+}
+
+// user returns the user metadata to store, including the
+// modification time
+func (m Meta) user() map[string]string {
+	u := map[string]string{}
+	for k, v := range m.User {
+		u[k] = v
+	}
+	if !m.ModTime.IsZero() {
+		u[mtimekey] = m.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	return u
+}
+
+// contentType returns the content type, or the one detected from
+// the name of the file and head, the start of its data
+func (m Meta) contentType(file string, head []byte) string {
+	if m.ContentType != "" {
+		return m.ContentType
+	}
+	return detect(file, head)
+}
+
+// headerMeta returns the metadata in an http response header
+func headerMeta(h http.Header) (m Meta) {
+	for name, p := range m.fields() {
+		*p = h.Get(name)
+	}
+	user := map[string]string{}
+	for k := range h {
+		lk := strings.ToLower(k)
+		for _, prefix := range []string{"x-amz-meta-", "x-goog-meta-"} {
+			if strings.HasPrefix(lk, prefix) {
+				user[strings.TrimPrefix(lk, prefix)] = h.Get(k)
+			}
+		}
+	}
+	t, _ := http.ParseTime(h.Get("Last-Modified"))
+	m.setUser(user, t)
+	return m
+}
+
+// headerflags are the flags setting the standard fields
+var headerflags = map[string]*string{
+	"content-type":        contenttype,
+	"cache-control":       cachecontrol,
+	"content-encoding":    contentencoding,
+	"content-disposition": contentdisposition,
+	"content-language":    contentlanguage,
+}
+
+// stat returns the metadata of file, if its driver has any
+func stat(file string) (m Meta, err error) {
+	if st, ok := driver[uri(file).Scheme].(stater); ok {
+		a, err := st.Stat(file)
+		return a.Meta, err
+	}
+	return m, nil
+}
+
+// carry returns the metadata of src that its copies get
+func carry(src string) (m Meta) {
+	if *metadrop != "all" && src != "-" {
+		var err error
+		if m, err = stat(src); err != nil {
+			log.Debug.Add("action", "meta", "src", src, "err", err).Printf("metadata not carried")
+		}
+	}
+	switch m.ContentType {
+	case kindUnknown, "binary/octet-stream":
+		// the default of s3 and gs says nothing, try detecting it
+		m.ContentType = ""
+	}
+	if *seek != 0 || *count != 0 {
+		// a part of the data does not have the same checksum
+		delete(m.User, "sha256")
+	}
+	m.apply()
+	return m
+}
+
+// apply applies -metadrop, the header flags, -meta, -metaset and
+// -tag to m, in that order
+func (m *Meta) apply() {
+	for _, name := range strings.Split(*metadrop, ",") {
+		m.drop(name)
+	}
+	for name, v := range headerflags {
+		if *v != "" {
+			m.set(name, *v)
+		}
+	}
+	for _, kv := range usermeta {
+		k, v, _ := strings.Cut(kv, "=")
+		if m.User == nil {
+			m.User = map[string]string{}
+		}
+		m.User[strings.ToLower(k)] = v
+	}
+	for _, kv := range metaset {
+		k, v, _ := strings.Cut(kv, "=")
+		m.set(k, v)
+	}
+	for _, kv := range tags {
+		k, v, _ := strings.Cut(kv, "=")
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+		m.Tags[k] = v
+	}
+}
+
+// carrier returns a function returning carry(src), which runs once
+// and only if a destination stores metadata
+func carrier(src string) func() Meta {
+	var (
+		once sync.Once
+		m    Meta
+	)
+	return func() Meta {
+		once.Do(func() { m = carry(src) })
+		return m
+	}
+}
+
+// create creates dst with the metadata from meta where the driver
+// supports it
+func create(dst string, meta func() Meta) (io.WriteCloser, error) {
+	dfs := driver[uri(dst).Scheme]
+	if c, ok := dfs.(metacreator); ok && dst != "-" {
+		return c.CreateMeta(dst, meta())
+	}
+	return dfs.Create(dst)
+}
+
+// checkmeta validates -metaset, -meta and -tag
+func checkmeta() error {
+	for flag, list := range map[string]strlist{"metaset": metaset, "meta": usermeta, "tag": tags} {
+		for _, kv := range list {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || k == "" {
+				return fmt.Errorf("%s: want name=value: %q", flag, kv)
+			}
+			if flag != "metaset" {
+				continue
+			}
+			if err := (&Meta{}).set(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if len(tags) > 10 {
+		// the limit of s3
+		return fmt.Errorf("tag: at most 10 tags")
+	}
+	return nil
+}
+
+// metareplacer replaces the metadata of a file in place
+type metareplacer interface {
+	ReplaceMeta(file string, m Meta) error
+}
+
+// dosetmeta replaces the metadata of the files under each src with
+// their own, changed by the metadata flags (see apply)
+func dosetmeta(src ...string) {
+	files := []string{}
+	for _, src := range src {
+		if _, ok := driver[uri(src).Scheme].(metareplacer); !ok {
+			log.Fatal.F("setmeta: scheme not supported: %s", src)
+		}
+		dir, err := find(src)
+		if err != nil {
+			log.Fatal.Add("action", "list", "src", src, "err", err).Printf("list error")
+		}
+		for _, f := range dir {
+			files = append(files, f.String())
+		}
+	}
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	errc := make(chan error, len(files))
+	for _, file := range files {
+		file := file
+		q.add(func() {
+			err := replacemeta(file)
+			line := log.Info.Add("action", "setmeta", "file", file)
+			if err != nil {
+				line = log.Error.Add("action", "setmeta", "file", file, "err", err)
+			}
+			line.Printf("setmeta")
+			errc <- err
+		}, file)
+	}
+	q.run()
+	for range files {
+		if <-errc != nil {
+			nerr++
+		}
+	}
+}
+
+// replacemeta replaces the metadata of file
+func replacemeta(file string) error {
+	m := Meta{}
+	if *metadrop != "all" {
+		var err error
+		if m, err = stat(file); err != nil {
+			return err
+		}
+	}
+	m.apply()
+	return driver[uri(file).Scheme].(metareplacer).ReplaceMeta(file, m)
+}
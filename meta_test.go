@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeaderMeta(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "text/html")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	h.Set("X-Amz-Meta-Owner", "ops")
+	h.Set("X-Goog-Meta-Build", "42")
+	h.Set("X-Amz-Meta-Mtime", "2020-01-02T03:04:05Z")
+	m := headerMeta(h)
+	if m.ContentType != "text/html" || m.CacheControl != "no-cache" {
+		t.Fatalf("standard fields: %+v", m)
+	}
+	if m.User["owner"] != "ops" || m.User["build"] != "42" || len(m.User) != 2 {
+		t.Fatalf("user metadata: %v", m.User)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !m.ModTime.Equal(want) {
+		t.Fatalf("mtime: have %v want %v", m.ModTime, want)
+	}
+	if have := m.user()[mtimekey]; have != "2020-01-02T03:04:05Z" {
+		t.Fatalf("stored mtime: %q", have)
+	}
+}
+
+func TestMetaSetDrop(t *testing.T) {
+	m := Meta{ContentType: "text/plain", User: map[string]string{"a": "1", "b": "2"}}
+	m.drop("b")
+	m.drop("Content-Type")
+	if err := m.set("cache-control", "max-age=60"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.set("mtime", "1577934245"); err != nil {
+		t.Fatal(err)
+	}
+	if m.ContentType != "" || m.CacheControl != "max-age=60" || len(m.User) != 1 || m.ModTime.Unix() != 1577934245 {
+		t.Fatalf("have %+v", m)
+	}
+	if err := m.set("mtime", "yesterday"); err == nil {
+		t.Fatal("bad mtime: want error")
+	}
+	m.drop("all")
+	if m.CacheControl != "" || m.User != nil || !m.ModTime.IsZero() {
+		t.Fatalf("drop all: have %+v", m)
+	}
+}
+
+func TestMetaApply(t *testing.T) {
+	defer func(u, s, tg strlist, cc, drop string) {
+		usermeta, metaset, tags, *cachecontrol, *metadrop = u, s, tg, cc, drop
+	}(usermeta, metaset, tags, *cachecontrol, *metadrop)
+	usermeta = strlist{"Build=42", "owner=ops"}
+	metaset = strlist{"owner=dev"}
+	tags = strlist{"team=media", "env=prod&test"}
+	*cachecontrol = "max-age=60"
+	*metadrop = "stale"
+	if err := checkmeta(); err != nil {
+		t.Fatal(err)
+	}
+	m := Meta{CacheControl: "no-cache", User: map[string]string{"stale": "1"}}
+	m.apply()
+	if m.CacheControl != "max-age=60" {
+		t.Fatalf("header flag: have %q", m.CacheControl)
+	}
+	if m.User["build"] != "42" || m.User["owner"] != "dev" || len(m.User) != 2 {
+		t.Fatalf("user metadata: %v", m.User)
+	}
+	if have := *m.tagging(); have != "env=prod%26test&team=media" {
+		t.Fatalf("tagging: have %q", have)
+	}
+	if (Meta{}).tagging() != nil {
+		t.Fatal("tagging: want nil without tags")
+	}
+	tags = strlist{"team"}
+	if checkmeta() == nil {
+		t.Fatal("bad tag: want error")
+	}
+}
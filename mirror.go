@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/as/log"
+)
+
+// mirrorurls are the http urls of the -mirror and -metalink
+// sources, resolved once at startup
+var mirrorurls []string
+
+// metasize is the file size advertised by -metalink (if any)
+var metasize int
+
+// resolveMirrors signs bucket mirrors so the accelerator can
+// fetch them over http
+func resolveMirrors(list []string) (urls []string) {
+	type S interface {
+		Sign(uri string) (string, error)
+	}
+	for _, m := range list {
+		switch uri(m).Scheme {
+		case "http", "https":
+			urls = append(urls, m)
+			continue
+		}
+		s, _ := driver[uri(m).Scheme].(S)
+		if s == nil {
+			log.Fatal.F("mirror: scheme not supported: %s", m)
+		}
+		su, err := s.Sign(m)
+		if err != nil {
+			log.Fatal.F("mirror: sign: %s: %v", m, err)
+		}
+		urls = append(urls, su)
+	}
+	return urls
+}
+
+// mirror is one source of a multi-source download
+type mirror struct {
+	url   string
+	dead  bool
+	fails int
+	n     int64
+	dur   time.Duration
+}
+
+func (m *mirror) rate() float64 {
+	if m.dur <= 0 {
+		return 0
+	}
+	return float64(m.n) / m.dur.Seconds()
+}
+
+// mirrorset spreads the blocks of a file across several urls and
+// drops the ones that fail or fall far behind the others. The last
+// live mirror is never dropped.
+type mirrorset struct {
+	sync.Mutex
+	m []*mirror
+}
+
+func newMirrorset(primary string) *mirrorset {
+	ms := &mirrorset{m: []*mirror{{url: primary}}}
+	for _, u := range mirrorurls {
+		if u != primary {
+			ms.m = append(ms.m, &mirror{url: u})
+		}
+	}
+	return ms
+}
+
+func (ms *mirrorset) live() (l []*mirror) {
+	for _, m := range ms.m {
+		if !m.dead {
+			l = append(l, m)
+		}
+	}
+	return l
+}
+
+// pick returns the mirror for the nth request
+func (ms *mirrorset) pick(n int) *mirror {
+	ms.Lock()
+	defer ms.Unlock()
+	l := ms.live()
+	return l[n%len(l)]
+}
+
+// drop marks m as dead unless it is the last one alive
+func (ms *mirrorset) drop(m *mirror, why string) {
+	if m.dead || len(ms.live()) < 2 {
+		return
+	}
+	m.dead = true
+	log.Warn.Add("action", "mirror", "url", m.url).Printf("dropping mirror: %s", why)
+}
+
+// report records the outcome of a request to m
+func (ms *mirrorset) report(m *mirror, n int64, dur time.Duration, err error) {
+	ms.Lock()
+	defer ms.Unlock()
+	m.n += n
+	m.dur += dur
+	if err != nil {
+		m.fails++
+		if m.fails > *maxretry {
+			ms.drop(m, err.Error())
+		}
+		return
+	}
+	l, rates := ms.live(), []float64{}
+	for _, m := range l {
+		if r := m.rate(); r > 0 {
+			rates = append(rates, r)
+		}
+	}
+	if len(rates) < 2 {
+		return
+	}
+	sort.Float64s(rates)
+	median := rates[len(rates)/2]
+	for _, m := range l {
+		if r := m.rate(); r > 0 && r < median/4 {
+			ms.drop(m, fmt.Sprintf("too slow: %0.3f MiB/s (median %0.3f MiB/s)", r/1024/1024, median/1024/1024))
+		}
+	}
+}
+
+// size returns the size agreed on by the mirrors. Mirrors that
+// disagree with the primary (or the first one that answers) are
+// dropped.
+func (ms *mirrorset) size() (size int, err error) {
+	sizes := make([]int, len(ms.m))
+	errs := make([]error, len(ms.m))
+	var wg sync.WaitGroup
+	for i, m := range ms.m {
+		wg.Add(1)
+		go func(i int, m *mirror) {
+			defer wg.Done()
+			sizes[i], errs[i] = httpsize(m.url)
+		}(i, m)
+	}
+	wg.Wait()
+	for i := range ms.m {
+		if errs[i] == nil && sizes[i] != 0 {
+			size = sizes[i]
+			break
+		}
+	}
+	if size == 0 {
+		return 0, errs[0]
+	}
+	if metasize != 0 && metasize != size {
+		return 0, fmt.Errorf("mirror: size %d does not match metalink size %d", size, metasize)
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	for i, m := range ms.m {
+		switch {
+		case errs[i] != nil:
+			ms.drop(m, errs[i].Error())
+		case sizes[i] != size:
+			ms.drop(m, fmt.Sprintf("size %d disagrees with %d", sizes[i], size))
+		}
+	}
+	return size, nil
+}
+
+// metalink is a metalink 4 (rfc5854) or 3 document
+type metalink struct {
+	Files  []mlfile `xml:"file"`
+	Files3 []mlfile `xml:"files>file"`
+}
+
+type mlfile struct {
+	Name         string   `xml:"name,attr"`
+	Size         int      `xml:"size"`
+	Hash         []mlhash `xml:"hash"`
+	Verification []mlhash `xml:"verification>hash"`
+	URL          []mlurl  `xml:"url"`
+	Resources    []mlurl  `xml:"resources>url"`
+}
+
+type mlhash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type mlurl struct {
+	Priority int    `xml:"priority,attr"`
+	Pref     int    `xml:"preference,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// readMetalink returns the urls of the first file in a metalink
+// ordered by priority, its size, and its strongest hash as
+// algo:hex (if any)
+func readMetalink(file string) (urls []string, size int, sum string, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	ml := metalink{}
+	if err = xml.Unmarshal(data, &ml); err != nil {
+		return nil, 0, "", fmt.Errorf("metalink: %w", err)
+	}
+	ml.Files = append(ml.Files, ml.Files3...)
+	if len(ml.Files) == 0 {
+		return nil, 0, "", fmt.Errorf("metalink: no files")
+	}
+	if len(ml.Files) > 1 {
+		log.Warn.F("metalink: %s: using only the first of %d files", file, len(ml.Files))
+	}
+	f := ml.Files[0]
+	type prio struct {
+		n int
+		u string
+	}
+	list := []prio{}
+	for _, u := range f.URL {
+		if u.Priority == 0 {
+			// unranked urls go last
+			u.Priority = 1 << 20
+		}
+		list = append(list, prio{u.Priority, strings.TrimSpace(u.Value)})
+	}
+	for _, u := range f.Resources {
+		// metalink 3 uses preference, higher is better
+		list = append(list, prio{100 - u.Pref, strings.TrimSpace(u.Value)})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].n < list[j].n })
+	for _, p := range list {
+		switch uri(p.u).Scheme {
+		case "http", "https", "s3", "gs":
+			urls = append(urls, p.u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, 0, "", fmt.Errorf("metalink: no usable urls")
+	}
+	best := ""
+	for _, h := range append(f.Hash, f.Verification...) {
+		name := strings.ReplaceAll(strings.ToLower(h.Type), "-", "")
+		if hashes[name] == nil || name != "md5" && !strings.HasPrefix(name, "sha") {
+			continue
+		}
+		// prefer the later sha2 variants
+		if best == "" || name > strings.Split(best, ":")[0] {
+			best = name + ":" + strings.ToLower(strings.TrimSpace(h.Value))
+		}
+	}
+	return urls, f.Size, best, nil
+}
+
+// checksum compares the digest of a finished copy to -expect
+func checksum(sum string) error {
+	if *expect == "" {
+		return nil
+	}
+	algo, want, _ := strings.Cut(*expect, ":")
+	if have := sumof(sum, algo); !strings.EqualFold(have, want) {
+		return fmt.Errorf("checksum mismatch: have %s:%s want %s", algo, have, *expect)
+	}
+	return nil
+}
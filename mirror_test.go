@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMetalink(t *testing.T) {
+	for i, tc := range []struct {
+		doc  string
+		urls []string
+		size int
+		sum  string
+	}{
+		{`<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+			<file name="a.bin">
+				<size>14471447</size>
+				<hash type="md5">d41d8cd98f00b204e9800998ecf8427e</hash>
+				<hash type="sha-256">E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855</hash>
+				<url priority="2">https://b.example.com/a.bin</url>
+				<url priority="1">https://a.example.com/a.bin</url>
+				<url>ftp://c.example.com/a.bin</url>
+			</file>
+		</metalink>`,
+			[]string{"https://a.example.com/a.bin", "https://b.example.com/a.bin"},
+			14471447,
+			"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{`<metalink version="3.0" xmlns="http://www.metalinker.org/">
+			<files><file name="a.bin">
+				<size>10</size>
+				<verification><hash type="sha1">da39a3ee5e6b4b0d3255bfef95601890afd80709</hash></verification>
+				<resources>
+					<url type="http" preference="10">http://slow.example.com/a.bin</url>
+					<url type="http" preference="90">http://fast.example.com/a.bin</url>
+				</resources>
+			</file></files>
+		</metalink>`,
+			[]string{"http://fast.example.com/a.bin", "http://slow.example.com/a.bin"},
+			10,
+			"sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		},
+	} {
+		file := filepath.Join(t.TempDir(), "a.meta4")
+		os.WriteFile(file, []byte(tc.doc), 0600)
+		urls, size, sum, err := readMetalink(file)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if len(urls) != len(tc.urls) {
+			t.Fatalf("test %d: urls: have %q want %q", i, urls, tc.urls)
+		}
+		for j := range urls {
+			if urls[j] != tc.urls[j] {
+				t.Fatalf("test %d: urls: have %q want %q", i, urls, tc.urls)
+			}
+		}
+		if size != tc.size || sum != tc.sum {
+			t.Fatalf("test %d: have %d %q want %d %q", i, size, sum, tc.size, tc.sum)
+		}
+	}
+}
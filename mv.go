@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/as/log"
+)
+
+// renamer moves a file without copying it
+type renamer interface {
+	Rename(src, dst string) error
+}
+
+// servercopier copies a file to another place of the same provider
+// without sending the data through ccp
+type servercopier interface {
+	ServerCopy(src, dst string, m Meta) error
+}
+
+// errNoServerCopy is returned by a servercopier that can not copy a
+// file, so it is copied the usual way
+var errNoServerCopy = errors.New("server side copy not possible")
+
+// moved and unmoved are the files that were and were not moved
+var (
+	moved   []string
+	unmoved []work
+)
+
+// domv moves src to dst: by renaming it, with a server side copy, or
+// with a verified copy. The source is deleted only once the
+// destination is confirmed.
+func domv(src, dst string, ec chan<- work) {
+	how, err := move(src, dst)
+	line := log.Info.Add("action", "move", "src", src, "dst", dst, "how", how)
+	if err != nil {
+		line = log.Error.Add("action", "move", "src", src, "dst", dst, "how", how, "err", err)
+	}
+	line.Printf("move")
+	ec <- work{src: src, dst: dst, err: err}
+}
+
+func move(src, dst string) (how string, err error) {
+	if samefile(src, dst) {
+		// a copy onto itself would confirm, and the delete
+		// would remove the only copy
+		return "", errors.New("source and destination are the same file")
+	}
+	sfs, scheme := driver[uri(src).Scheme], uri(src).Scheme
+	same := scheme == uri(dst).Scheme || localscheme(scheme) && localscheme(uri(dst).Scheme)
+	if r, ok := sfs.(renamer); ok && same {
+		if err = r.Rename(src, dst); err == nil {
+			return "rename", nil
+		}
+		// e.g., across file systems
+		log.Debug.Add("action", "move", "src", src, "dst", dst, "err", err).Printf("rename failed, copying")
+	}
+	err = errNoServerCopy
+	if c, ok := sfs.(servercopier); ok && same {
+		how, err = "server copy", c.ServerCopy(src, dst, carry(src))
+	}
+	if err == errNoServerCopy {
+		how = "copy"
+		c := make(chan work, 1)
+		docp(src, dst, c, nil)
+		err = (<-c).err
+	}
+	if err != nil {
+		return how, err
+	}
+	if err = confirm(src, dst); err != nil {
+		return how, err
+	}
+	if err = sfs.Delete(src); err != nil {
+		return how, fmt.Errorf("copied, but the source was not deleted: %w", err)
+	}
+	return how, nil
+}
+
+func localscheme(scheme string) bool {
+	return scheme == "" || scheme == "file"
+}
+
+// samefile reports whether src and dst name the same file
+func samefile(src, dst string) bool {
+	su, du := uri(src), uri(dst)
+	if localscheme(su.Scheme) && localscheme(du.Scheme) {
+		s, err := filepath.Abs(localize(src))
+		if err != nil {
+			return false
+		}
+		d, err := filepath.Abs(localize(dst))
+		if err != nil {
+			return false
+		}
+		if s == d {
+			return true
+		}
+		si, err := os.Stat(s)
+		if err != nil {
+			return false
+		}
+		di, err := os.Stat(d)
+		return err == nil && os.SameFile(si, di)
+	}
+	return treekey(&su) == treekey(&du)
+}
+
+// confirm checks that dst has the size of src, and the checksums that
+// both have. Copies are also verified against the data sent (see
+// -verify).
+func confirm(src, dst string) error {
+	sa, err := statattr(src)
+	if err != nil {
+		return fmt.Errorf("confirm: %w", err)
+	}
+	da, err := statattr(dst)
+	if err != nil {
+		return fmt.Errorf("confirm: %w", err)
+	}
+	if sa.Size != da.Size {
+		return fmt.Errorf("confirm: %s has %d bytes, the source %d", dst, da.Size, sa.Size)
+	}
+	if sa.MD5 != nil && da.MD5 != nil && !bytes.Equal(sa.MD5, da.MD5) {
+		return fmt.Errorf("confirm: %s: md5 mismatch", dst)
+	}
+	if sa.CRC32C != nil && da.CRC32C != nil && *sa.CRC32C != *da.CRC32C {
+		return fmt.Errorf("confirm: %s: crc32c mismatch", dst)
+	}
+	se, de := strings.Trim(sa.ETag, `"`), strings.Trim(da.ETag, `"`)
+	if len(se) == 32 && len(de) == 32 && !sa.Opaque && !da.Opaque && se != de {
+		// both are the md5 of the data
+		return fmt.Errorf("confirm: %s: etag mismatch", dst)
+	}
+	return nil
+}
+
+// rmdirs removes the directories under root (and root) that moving
+// the files left empty
+func rmdirs(root string, moved []string) {
+	root = filepath.Clean(root)
+	under := func(d string) bool {
+		return d == root || strings.HasPrefix(d, root+string(filepath.Separator))
+	}
+	dirs := map[string]bool{}
+	for _, file := range moved {
+		for d := filepath.Dir(filepath.Clean(file)); under(d) && !dirs[d]; d = filepath.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	list := []string{}
+	for d := range dirs {
+		list = append(list, d)
+	}
+	// the deepest first
+	sort.Slice(list, func(i, j int) bool { return len(list[i]) > len(list[j]) })
+	for _, d := range list {
+		os.Remove(d) // fails if not empty
+	}
+}
+
+// report prints the files that were not moved, as tab separated
+// source, destination and error
+func report() {
+	for _, w := range unmoved {
+		fmt.Printf("%s\t%s\t%v\n", w.src, w.dst, w.err)
+	}
+	if len(unmoved) > 0 {
+		log.Error.Add("action", "move", "failed", len(unmoved)).Printf("files not moved")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfirm(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(data), 0666)
+		return file
+	}
+	src := write("src", "data")
+	if err := confirm(src, write("same", "data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := confirm(src, write("short", "dat")); err == nil {
+		t.Fatal("size mismatch: want error")
+	}
+	if err := confirm(src, filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("missing destination: want error")
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f")
+	os.WriteFile(file, nil, 0666)
+	for _, tc := range []struct {
+		src, dst string
+		want     bool
+	}{
+		{"s3://b/k", "s3://b/k", true},
+		{"s3://b/k", "s3://b//x/../k", true},
+		{"s3://b/k", "s3://b/k2", false},
+		{"s3://b/k", "gs://b/k", false},
+		{"s3://b/k", "s3://c/k", false},
+		{file, "file://" + file, true},
+		{file, filepath.Join(dir, ".", "f"), true},
+		{file, filepath.Join(dir, "g"), false},
+	} {
+		if have := samefile(tc.src, tc.dst); have != tc.want {
+			t.Errorf("samefile(%q, %q): have %v want %v", tc.src, tc.dst, have, tc.want)
+		}
+	}
+	if _, err := move(file, file); err == nil {
+		t.Fatal("move onto itself: want error")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("move onto itself: %v", err)
+	}
+}
+
+func TestRmdirs(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tree")
+	for _, d := range []string{"a/b", "c", "keep", "empty"} {
+		os.MkdirAll(filepath.Join(root, d), 0777)
+	}
+	os.WriteFile(filepath.Join(root, "keep", "x"), nil, 0666)
+	rmdirs(root, []string{filepath.Join(root, "a/b/f"), filepath.Join(root, "c/f"), filepath.Join(root, "keep/f")})
+	for d, want := range map[string]bool{"a": false, "c": false, "keep": true, "empty": true} {
+		if _, err := os.Stat(filepath.Join(root, d)); (err == nil) != want {
+			t.Errorf("%s: exists: have %v want %v", d, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// chunksize is the size of one buffer of a prefetched source
+	chunksize = 8 * 1024 * 1024
+
+	// spoolchunks is how many buffers a source fills ahead of the
+	// reader, so prefetching stays within -maxmem and -tmp
+	spoolchunks = 4
+)
+
+var errSpoolClosed = errors.New("prefetch: spool closed")
+
+// spool buffers a source that is read ahead of its turn. The data is
+// kept in a list of chunks which are allocated with newstore, so they
+// live in memory while the -maxmem budget allows and spill to disk
+// otherwise. Chunks are freed as soon as they are read, and the fill
+// waits for the reader once it is spoolchunks ahead.
+type spool struct {
+	sync.Mutex
+	cond    *sync.Cond
+	opened  chan bool
+	openerr error
+
+	chunk   []*chunk
+	off     int // read offset in chunk[0]
+	done    bool
+	closed  bool
+	reading bool // the source is being written
+	err     error
+}
+
+type chunk struct {
+	Store
+	n int // bytes written
+}
+
+func newSpool() *spool {
+	s := &spool{opened: make(chan bool)}
+	s.cond = sync.NewCond(s)
+	return s
+}
+
+// fill opens src and copies it into the spool
+func (s *spool) fill(src string) {
+	fd, err := driver[uri(src).Scheme].Open(src)
+	s.openerr = err
+	close(s.opened)
+	if err == nil {
+		_, err = io.Copy(s, fd)
+		fd.Close()
+	}
+	s.finish(err)
+}
+
+func (s *spool) finish(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	s.done, s.err = true, err
+	if len(s.chunk) > 0 {
+		s.chunk[len(s.chunk)-1].Fin()
+	}
+	s.cond.Broadcast()
+}
+
+func (s *spool) Write(p []byte) (n int, err error) {
+	var c *chunk
+	for len(p) > 0 {
+		if c == nil || c.n == chunksize {
+			s.Lock()
+			for len(s.chunk) >= spoolchunks && !s.closed {
+				s.cond.Wait()
+			}
+			s.Unlock()
+
+			// the chunk may be slow to create on disk, so it is
+			// created without holding the lock the reader needs
+			next := &chunk{Store: newstore(n/chunksize, chunksize, s.starved)}
+			if err := next.Init(); err != nil {
+				return n, err
+			}
+			s.Lock()
+			if s.closed {
+				s.Unlock()
+				next.Close()
+				return n, errSpoolClosed
+			}
+			if c != nil {
+				c.Fin()
+			}
+			s.chunk = append(s.chunk, next)
+			s.Unlock()
+			c = next
+		}
+
+		// chunks have a fixed capacity, so they are never moved and
+		// can be read while this part is written outside the lock
+		q := p
+		if room := chunksize - c.n; len(q) > room {
+			q = q[:room]
+		}
+		m, err := c.Write(q)
+		s.Lock()
+		c.n += m
+		closed := s.closed
+		s.cond.Broadcast()
+		s.Unlock()
+		n += m
+		p = p[m:]
+		if closed {
+			return n, errSpoolClosed
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// starved reports whether the reader has read every chunk. A closed
+// spool is starved too: the fill must not wait for space, it stops.
+func (s *spool) starved() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.reading && len(s.chunk) == 0 || s.closed
+}
+
+func (s *spool) Read(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	for {
+		if len(s.chunk) > 0 {
+			c := s.chunk[0]
+			if s.off < c.n {
+				if len(p) > c.n-s.off {
+					p = p[:c.n-s.off]
+				}
+				m, err := c.ReadAt(p, int64(s.off))
+				s.off += m
+				if m > 0 || (err != nil && err != io.EOF) {
+					return m, err
+				}
+			} else if c.n == chunksize || len(s.chunk) > 1 || s.done {
+				// this chunk is complete and was read entirely
+				c.Close()
+				s.chunk, s.off = s.chunk[1:], 0
+				s.cond.Broadcast() // room for the fill
+				continue
+			}
+		}
+		if s.done && len(s.chunk) == 0 {
+			if s.err != nil {
+				return 0, s.err
+			}
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+}
+
+// Close frees the chunks that were not read and stops the fill
+func (s *spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, c := range s.chunk {
+		c.Close()
+	}
+	s.chunk = nil
+	s.cond.Broadcast()
+	freed() // the fill may be waiting for space
+	return nil
+}
+
+// prefetch opens and buffers up to n sources ahead of the one being
+// written, so concatenating many small files does not pay the open
+// latency of each file in turn. The sources are still handed out
+// strictly in order.
+type prefetch struct {
+	spool []*spool
+	slot  chan bool
+}
+
+func newPrefetch(src []string, n int) *prefetch {
+	p := &prefetch{slot: make(chan bool, n)}
+	for range src {
+		p.spool = append(p.spool, newSpool())
+	}
+	go func() {
+		for i, src := range src {
+			p.slot <- true
+			go p.spool[i].fill(src)
+		}
+	}()
+	return p
+}
+
+// open returns the ith source once it is open
+func (p *prefetch) open(i int) (io.ReadCloser, error) {
+	s := p.spool[i]
+	<-s.opened
+	if s.openerr != nil {
+		return nil, s.openerr
+	}
+	s.Lock()
+	s.reading = true
+	s.Unlock()
+	freed() // its fill may be waiting for space
+	return io.NopCloser(s), nil
+}
+
+// done frees the buffers of the ith source and its slot; it is
+// called once the source was written (or failed)
+func (p *prefetch) done(i int) {
+	p.spool[i].Close()
+	<-p.slot
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefetchOrder(t *testing.T) {
+	dir := t.TempDir()
+	var src []string
+	for i := 0; i < 5; i++ {
+		file := filepath.Join(dir, fmt.Sprint(i))
+		os.WriteFile(file, []byte(fmt.Sprintf("source %d\n", i)), 0666)
+		src = append(src, file)
+	}
+	src = append(src, filepath.Join(dir, "missing"))
+
+	p := newPrefetch(src, 2)
+	for i := range src[:5] {
+		r, err := p.open(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := io.ReadAll(r)
+		if want := fmt.Sprintf("source %d\n", i); string(have) != want || err != nil {
+			t.Fatalf("source %d: have %q, %v want %q", i, have, err, want)
+		}
+		p.done(i)
+	}
+	if _, err := p.open(5); err == nil {
+		t.Fatal("missing source: want open error")
+	}
+	p.done(5)
+}
+
+func TestSpoolClose(t *testing.T) {
+	s := newSpool()
+	if _, err := s.Write([]byte("unread")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, err := s.Write([]byte("more")); err != errSpoolClosed {
+		t.Fatalf("write after close: have %v want %v", err, errSpoolClosed)
+	}
+}
+
+func TestSpoolBackPressure(t *testing.T) {
+	defer func(n int) { chunksize = n }(chunksize)
+	chunksize = 16
+	data := bytes.Repeat([]byte("0123456789"), 20)
+	s := newSpool()
+	go func() {
+		_, err := s.Write(data)
+		s.finish(err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.Lock()
+	ahead := len(s.chunk)
+	s.Unlock()
+	if ahead > spoolchunks {
+		t.Fatalf("fill is %d chunks ahead, want at most %d", ahead, spoolchunks)
+	}
+	have, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Fatalf("have %q want %q", have, data)
+	}
+}
+
+func TestSpoolCloseUnblocksFill(t *testing.T) {
+	defer func(n int) { chunksize = n }(chunksize)
+	chunksize = 16
+	s := newSpool()
+	done := make(chan error)
+	go func() {
+		_, err := s.Write(make([]byte, 1000))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-done:
+		if err != errSpoolClosed {
+			t.Fatalf("have %v want %v", err, errSpoolClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fill still blocked after close")
+	}
+}
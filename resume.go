@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/as/log"
+)
+
+// resumer is implemented by writers that can continue an upload
+// started by a previous process. Resume is called before the first
+// write with a fingerprint of the source and its size, and returns
+// the number of source bytes the destination already has.
+type resumer interface {
+	Resume(fingerprint string, size int) (int64, error)
+}
+
+// upstate is the persisted progress of one resumable upload. It is
+// keyed by the destination url and invalidated when the source
+// fingerprint changes.
+type upstate struct {
+	sync.Mutex `json:"-"`
+	file       string
+
+	Dst         string
+	Fingerprint string
+	UploadID    string `json:",omitempty"` // s3 multipart upload id
+	Session     string `json:",omitempty"` // gs resumable session uri
+	PartSize    int64
+	Parts       []uppart `json:",omitempty"`
+}
+
+type uppart struct {
+	N    int64
+	ETag string
+	Size int64
+}
+
+func statefile(dst string) string {
+	return filepath.Join(*statedir, "upload", fmt.Sprintf("%x.json", sha1.Sum([]byte(dst))))
+}
+
+func defaultStatedir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "ccp")
+}
+
+// loadState returns the saved state for dst, or a fresh state
+// if nothing was saved.
+func loadState(dst string) *upstate {
+	st := &upstate{Dst: dst, file: statefile(dst)}
+	data, err := os.ReadFile(st.file)
+	if err != nil {
+		return st
+	}
+	if err = json.Unmarshal(data, st); err != nil {
+		log.Warn.Add("file", st.file, "err", err).Printf("resume: ignoring corrupt upload state")
+		return &upstate{Dst: dst, file: st.file}
+	}
+	return st
+}
+
+// save writes the state atomically. The caller must hold the lock.
+func (st *upstate) save() error {
+	if err := os.MkdirAll(filepath.Dir(st.file), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := st.file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.file)
+}
+
+// done removes the state once the upload is complete
+func (st *upstate) done() {
+	os.Remove(st.file)
+}
+
+// add records a completed part and persists the state
+func (st *upstate) add(p uppart) {
+	st.Lock()
+	defer st.Unlock()
+	st.Parts = append(st.Parts, p)
+	sort.Slice(st.Parts, func(i, j int) bool { return st.Parts[i].N < st.Parts[j].N })
+	if err := st.save(); err != nil {
+		log.Warn.Add("file", st.file, "err", err).Printf("resume: failed to save upload state")
+	}
+}
+
+// contiguous returns the prefix of parts numbered 1..k that are
+// all exactly st.PartSize bytes long. Only these can be kept when
+// resuming because the source is replayed sequentially.
+func (st *upstate) contiguous() (parts []uppart) {
+	for i, p := range st.Parts {
+		if p.N != int64(i+1) || p.Size != st.PartSize {
+			break
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// resumePartsize picks a part size that keeps a file of the given
+// size under the s3 limit of 10000 parts
+func resumePartsize(size int) int64 {
+	const (
+		MiB      = 1024 * 1024
+		minpart  = 32 * MiB
+		maxparts = 10000
+	)
+	ps := int64(minpart)
+	if need := int64(size)/maxparts + 1; need > ps {
+		ps = (need + MiB - 1) / MiB * MiB
+	}
+	return ps
+}
+
+// fingerprint identifies the source of a resumable upload. It is
+// empty when the source can not be identified (for example stdin),
+// in which case the upload starts from scratch.
+func fingerprint(src string) (fp string, size int) {
+	u := uri(src)
+	id := fmt.Sprintf("%s seek=%d count=%d", src, *seek, *count)
+	switch u.Scheme {
+	case "", "file":
+		if src == "-" {
+			return "", 0
+		}
+		fi, err := os.Stat(localize(src))
+		if err != nil {
+			return "", 0
+		}
+		return fmt.Sprintf("%s size=%d mtime=%d", id, fi.Size(), fi.ModTime().UnixNano()), int(fi.Size())
+	}
+	sfs := driver[u.Scheme]
+	if sfs == nil {
+		return "", 0
+	}
+	list, err := sfs.List(src)
+	if err != nil {
+		return "", 0
+	}
+	for _, f := range list {
+		if treekey(f.URL) != treekey(&u) {
+			continue
+		}
+		// the size alone would resume a file rewritten with the
+		// same length onto stale parts
+		v := srcversion(src, f)
+		if v == "" {
+			return "", 0
+		}
+		return fmt.Sprintf("%s size=%d%s", id, f.Size, v), f.Size
+	}
+	return "", 0
+}
+
+// srcversion returns what changes when the remote file f is rewritten:
+// its upload time and whatever etag, checksum or time its driver
+// reports. It is empty when none of these are known.
+func srcversion(src string, f Info) (v string) {
+	if !f.ModTime.IsZero() {
+		v += fmt.Sprintf(" uploaded=%d", f.ModTime.UnixNano())
+	}
+	st, ok := driver[f.Scheme].(stater)
+	if !ok {
+		return v
+	}
+	a, err := st.Stat(src)
+	if err != nil {
+		return v
+	}
+	if a.ETag != "" {
+		v += " etag=" + a.ETag
+	}
+	if a.MD5 != nil {
+		v += fmt.Sprintf(" md5=%x", a.MD5)
+	}
+	if a.CRC32C != nil {
+		v += fmt.Sprintf(" crc32c=%08x", *a.CRC32C)
+	}
+	if !a.ModTime.IsZero() {
+		v += fmt.Sprintf(" mtime=%d", a.ModTime.UnixNano())
+	}
+	return v
+}
+
+// resume asks dst where to continue and advances src to that
+// position; it returns the number of bytes skipped
+func resume(dst io.Writer, src io.Reader, file string) (int64, error) {
+	r, ok := dst.(resumer)
+	if !ok || !*resumable {
+		return 0, nil
+	}
+	fp, size := fingerprint(file)
+	if *count != 0 && *count < size-*seek {
+		size = *count
+	} else if *seek != 0 {
+		size -= *seek
+	}
+	off, err := r.Resume(fp, size)
+	if err != nil || off == 0 {
+		return 0, err
+	}
+	log.Info.Add("action", "resume", "src", file, "offset", off).Printf("resuming upload")
+	if s, ok := src.(io.Seeker); ok && *seek == 0 {
+		_, err = s.Seek(off, io.SeekStart)
+		return off, err
+	}
+	n, err := io.CopyN(io.Discard, rx{src}, off)
+	if err == nil && n != off {
+		err = errors.New("resume: source shorter than uploaded data")
+	}
+	return n, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContiguous(t *testing.T) {
+	for _, tc := range []struct {
+		parts []uppart
+		want  int
+	}{
+		{nil, 0},
+		{[]uppart{{N: 1, Size: 4}, {N: 2, Size: 4}, {N: 3, Size: 4}}, 3},
+		{[]uppart{{N: 1, Size: 4}, {N: 3, Size: 4}}, 1}, // gap
+		{[]uppart{{N: 2, Size: 4}}, 0},                  // no first part
+		{[]uppart{{N: 1, Size: 4}, {N: 2, Size: 3}}, 1}, // short part
+	} {
+		st := &upstate{PartSize: 4, Parts: tc.parts}
+		if have := len(st.contiguous()); have != tc.want {
+			t.Errorf("contiguous(%v): have %d parts want %d", tc.parts, have, tc.want)
+		}
+	}
+}
+
+func TestResumePartsize(t *testing.T) {
+	const MiB = 1 << 20
+	for _, tc := range []struct {
+		size int
+		want int64
+	}{
+		{0, 32 * MiB},
+		{10000 * 32 * MiB, 33 * MiB},
+		{5 << 40, 525 * MiB},
+	} {
+		ps := resumePartsize(tc.size)
+		if ps != tc.want {
+			t.Errorf("resumePartsize(%d): have %d want %d", tc.size, ps, tc.want)
+		}
+		if int64(tc.size)/ps >= 10000 {
+			t.Errorf("resumePartsize(%d): %d parts", tc.size, int64(tc.size)/ps+1)
+		}
+	}
+}
+
+func TestCommitted(t *testing.T) {
+	for _, tc := range []struct {
+		rng  string
+		want int64
+	}{
+		{"", 0}, // nothing committed yet
+		{"bytes=0-0", 1},
+		{"bytes=0-8388607", 8 << 20},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.rng != "" {
+			resp.Header.Set("Range", tc.rng)
+		}
+		if have := committed(resp); have != tc.want {
+			t.Errorf("committed(%q): have %d want %d", tc.rng, have, tc.want)
+		}
+	}
+}
+
+func TestFingerprintRemote(t *testing.T) {
+	s3 := driver["s3"]
+	t.Cleanup(func() { driver["s3"] = s3 })
+
+	driver["s3"] = statfs{prefixfs: prefixfs{"k"}, attr: Attr{ETag: `"a"`}}
+	a, size := fingerprint("s3://b/k")
+	if a == "" || size != 1 {
+		t.Fatalf("have %q, %d", a, size)
+	}
+	driver["s3"] = statfs{prefixfs: prefixfs{"k"}, attr: Attr{ETag: `"b"`}}
+	if b, _ := fingerprint("s3://b/k"); b == a {
+		t.Fatalf("same size, different etag: both %q", a)
+	}
+
+	// nothing but the size is known, so it can not be resumed
+	driver["s3"] = prefixfs{"k"}
+	if fp, _ := fingerprint("s3://b/k"); fp != "" {
+		t.Fatalf("have %q want none", fp)
+	}
+}
+
+// resumefs is a bucket whose uploads already have the first skip bytes
+type resumefs struct {
+	prefixfs
+	skip int64
+	w    *resumew
+}
+
+type resumew struct {
+	bytes.Buffer
+	skip int64
+}
+
+func (w *resumew) Resume(string, int) (int64, error) { return w.skip, nil }
+func (w *resumew) Close() error                      { return nil }
+
+func (r *resumefs) Create(string) (io.WriteCloser, error) {
+	r.w = &resumew{skip: r.skip}
+	return r.w, nil
+}
+
+func TestResumeHash(t *testing.T) {
+	data := "hello, resumed world"
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	fs := &resumefs{skip: 7}
+	s3 := driver["s3"]
+	driver["s3"] = fs
+	defer func() { driver["s3"] = s3 }()
+	defer func(r bool, h, e string) { *resumable, *hashname, *expect = r, h, e }(*resumable, *hashname, *expect)
+	*resumable, *hashname, *expect = true, "md5", "md5:"+want
+
+	ec := make(chan work, 1)
+	docp(src, "s3://b/k", ec, nil)
+	w := <-ec
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	if have := fs.w.String(); have != data[7:] {
+		t.Fatalf("uploaded %q, want %q", have, data[7:])
+	}
+	if have := sumof(w.sum, "md5"); have != want {
+		t.Fatalf("md5: have %s want %s (the whole source)", have, want)
+	}
+
+	*expect = "md5:00"
+	docp(src, "s3://b/k", ec, nil)
+	if w := <-ec; w.err == nil {
+		t.Fatalf("-expect mismatch: have %v", w.err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// queue runs file copies with at most -j of them in flight, and at
+// most the -jscheme limit for any scheme used by the source or the
+// destination of a copy
+type queue struct {
+	sync.Mutex
+	jobs   []job
+	limit  map[string]chan bool
+	worker int
+}
+
+type job struct {
+	schemes []string
+	run     func()
+}
+
+func newQueue(workers int, limits string) (*queue, error) {
+	q := &queue{worker: workers, limit: map[string]chan bool{}}
+	for _, kv := range strings.Split(limits, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("jscheme: bad limit: %q", kv)
+		}
+		q.limit[k] = make(chan bool, n)
+	}
+	return q, nil
+}
+
+// add queues fn, which copies from src to one or more dst
+func (q *queue) add(fn func(), src string, dst ...string) {
+	seen := map[string]bool{}
+	j := job{run: fn}
+	for _, file := range append([]string{src}, dst...) {
+		s := uri(file).Scheme
+		if s == "" {
+			s = "file"
+		}
+		if !seen[s] && q.limit[s] != nil {
+			seen[s] = true
+			j.schemes = append(j.schemes, s)
+		}
+	}
+	// always take the scheme tokens in the same order so two
+	// workers can not deadlock each other
+	sort.Strings(j.schemes)
+	q.jobs = append(q.jobs, j)
+}
+
+func (q *queue) next() (j job, ok bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.jobs) == 0 {
+		return j, false
+	}
+	j, q.jobs = q.jobs[0], q.jobs[1:]
+	return j, true
+}
+
+// run starts the workers; it does not wait for them
+func (q *queue) run() {
+	n := q.worker
+	if n <= 0 || n > len(q.jobs) {
+		n = len(q.jobs)
+	}
+	for i := 0; i < n; i++ {
+		go func() {
+			defer trap()
+			for j, ok := q.next(); ok; j, ok = q.next() {
+				for _, s := range j.schemes {
+					q.limit[s] <- true
+				}
+				j.run()
+				for _, s := range j.schemes {
+					<-q.limit[s]
+				}
+			}
+		}()
+	}
+}
+
+// schedule orders the list of files to copy (see -order)
+func schedule(list []Info, order string) error {
+	switch order {
+	case "list":
+	case "size":
+		// largest first, so the long copies start early and the
+		// small ones fill the gaps at the end. Unknown sizes go last.
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Size > list[j].Size
+		})
+	default:
+		return fmt.Errorf("order: unknown order: %q (want list or size)", order)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// busy runs jobs on q and returns the most that were running at once
+func busy(t *testing.T, q *queue, add func(fn func())) int32 {
+	var (
+		wg        sync.WaitGroup
+		now, peak int32
+	)
+	fn := func() {
+		defer wg.Done()
+		n := atomic.AddInt32(&now, 1)
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&now, -1)
+	}
+	add(fn)
+	wg.Add(len(q.jobs))
+	q.run()
+	done := make(chan bool)
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+	return atomic.LoadInt32(&peak)
+}
+
+func TestQueueJobs(t *testing.T) {
+	q, _ := newQueue(3, "")
+	peak := busy(t, q, func(fn func()) {
+		for i := 0; i < 20; i++ {
+			q.add(fn, "/src", "/dst")
+		}
+	})
+	if peak > 3 || peak < 2 {
+		t.Fatalf("%d jobs at once, want up to 3", peak)
+	}
+}
+
+func TestQueueScheme(t *testing.T) {
+	q, err := newQueue(8, "s3=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the source and the destination scheme both count
+	peak := busy(t, q, func(fn func()) {
+		for i := 0; i < 5; i++ {
+			q.add(fn, "s3://b/a", "/dst")
+			q.add(fn, "/src", "s3://b/b")
+		}
+	})
+	if peak != 1 {
+		t.Fatalf("%d s3 jobs at once, want 1", peak)
+	}
+	if _, err := newQueue(1, "s3=0"); err == nil {
+		t.Fatal("s3=0: want error")
+	}
+}
+
+func TestQueueNoDeadlock(t *testing.T) {
+	q, _ := newQueue(8, "s3=1,gs=1")
+	busy(t, q, func(fn func()) {
+		for i := 0; i < 10; i++ {
+			q.add(fn, "s3://b/a", "gs://c/a")
+			q.add(fn, "gs://c/b", "s3://b/b")
+		}
+	})
+}
+
+func TestOrderSize(t *testing.T) {
+	info := func(p string, size int) Info { return Info{URL: &url.URL{Path: p}, Size: size} }
+	list := []Info{info("a", 1), info("b", 3), info("c", 2), info("d", 3)}
+	if err := schedule(list, "size"); err != nil {
+		t.Fatal(err)
+	}
+	have := ""
+	for _, f := range list {
+		have += f.Path
+	}
+	if have != "bdca" {
+		t.Fatalf("have %s want bdca (largest first, stable)", have)
+	}
+	if err := schedule(list, "random"); err == nil {
+		t.Fatal("random: want error")
+	}
+}
@@ -1,6 +1,19 @@
 package main
 
-import "github.com/as/log"
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/as/log"
+)
 
 const (
 	kindUnknown = "application/octet-stream"
@@ -12,40 +25,276 @@ const (
 	kindJPEG    = "image/jpeg"
 	kindPNG     = "image/png"
 	kindMPEG    = "video/MP2T"
+	kindGIF     = "image/gif"
+	kindWEBP    = "image/webp"
+	kindPDF     = "application/pdf"
+	kindGZIP    = "application/gzip"
+	kindZIP     = "application/zip"
+	kindZSTD    = "application/zstd"
+	kindXZ      = "application/x-xz"
+	kindBZIP2   = "application/x-bzip2"
+	kind7Z      = "application/x-7z-compressed"
+	kindTAR     = "application/x-tar"
+	kindPARQUET = "application/vnd.apache.parquet"
+	kindMKV     = "video/x-matroska"
+	kindOGG     = "audio/ogg"
+	kindELF     = "application/x-elf"
+	kindWASM    = "application/wasm"
 )
 
-var kindTab = [...]struct {
-	kind  string
-	at    int
-	magic string
-}{
+// magic matches the bytes at an offset of a file's head, or calls
+// match if it is not nil. A generic magic is that of a container
+// other formats are built on (e.g., docx and jar are zip files), so
+// the file extension says more.
+type magic struct {
+	kind    string
+	at      int
+	magic   string
+	match   func(head []byte) bool
+	generic bool
+}
+
+// strong reports whether m says more than the file extension. Short
+// signatures like "BZh" or "\xff\xfb" may well start text or other
+// data, so they only count when the extension is unknown.
+func (m magic) strong() bool {
+	return !m.generic && (m.match != nil || len(m.magic) >= 4)
+}
+
+func (m magic) matches(head []byte) bool {
+	if m.match != nil {
+		return m.match(head)
+	}
+	return len(head) >= m.at+len(m.magic) && string(head[m.at:m.at+len(m.magic)]) == m.magic
+}
+
+// kindTab is checked in order; -mimetypes files can add to it
+var kindTab = []magic{
 	{kind: kindMP4, at: 4, magic: "ftypmp42"},
 	{kind: kindMP4, at: 4, magic: "ftypMSNV"},
-	{kind: kindMP4, at: 4, magic: "ftypisom"},
+	{kind: kindMP4, at: 4, magic: "ftypisom", generic: true},
+	{kind: kindM4A, at: 4, magic: "ftypM4A"},
 	{kind: kindFLAC, magic: "fLaC"},
+	{kind: kindMP3, magic: "ID3"},
 	{kind: kindMP3, magic: "\xff\xfb"},
 	{kind: kindMP3, magic: "\xff\xf3"},
 	{kind: kindMP3, magic: "\xff\xf2"},
-	{kind: kindMP3, magic: "ID3"},
 	{kind: kindWAV, at: 8, magic: "WAVE"},
-	{kind: kindM4A, at: 4, magic: "ftypM4A"},
-	{kind: kindJPEG, at: 0, magic: "\xff\xd8\xff\xe0"},
-	{kind: kindPNG, at: 0, magic: "\x89\x50\x4e\x47"},
-	{kind: kindMPEG, at: 0, magic: "G"},
+	{kind: kindWEBP, at: 8, magic: "WEBP"},
+	{kind: kindJPEG, magic: "\xff\xd8\xff"},
+	{kind: kindPNG, magic: "\x89PNG\r\n\x1a\n"},
+	{kind: kindGIF, magic: "GIF87a"},
+	{kind: kindGIF, magic: "GIF89a"},
+	{kind: kindPDF, magic: "%PDF-"},
+	{kind: kindGZIP, magic: "\x1f\x8b"},
+	{kind: kindZIP, magic: "PK\x03\x04", generic: true},
+	{kind: kindZSTD, magic: "\x28\xb5\x2f\xfd"},
+	{kind: kindXZ, magic: "\xfd7zXZ\x00"},
+	{kind: kindBZIP2, magic: "BZh"},
+	{kind: kind7Z, magic: "7z\xbc\xaf\x27\x1c"},
+	{kind: kindTAR, at: 257, magic: "ustar"},
+	{kind: kindPARQUET, magic: "PAR1"},
+	{kind: kindMKV, magic: "\x1a\x45\xdf\xa3", generic: true},
+	{kind: kindOGG, magic: "OggS", generic: true},
+	{kind: kindELF, magic: "\x7fELF"},
+	{kind: kindWASM, magic: "\x00asm"},
+	{kind: kindMPEG, match: isTransportStream},
 }
 
-func sniffContent(head []byte) (kind string) {
-	const minHeadLen = 16
+// tspacket is the size of an mpeg transport stream packet
+const tspacket = 188
+
+// isTransportStream reports whether head starts with at least two
+// mpeg-ts packets; each one starts with the sync byte 'G'
+func isTransportStream(head []byte) bool {
+	if len(head) <= tspacket {
+		return false
+	}
+	for i := 0; i < len(head) && i <= 2*tspacket; i += tspacket {
+		if head[i] != 'G' {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffLen is how much of the head of a file detection uses
+const sniffLen = 512
+
+// exttypes maps file extensions to content types (see -mimetypes);
+// they take precedence over everything but -content-type
+var exttypes = map[string]string{}
+
+// containertypes are formats built on zip that the mime package may
+// not know (it reads them from the system, if there)
+var containertypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".jar":  "application/java-archive",
+	".apk":  "application/vnd.android.package-archive",
+	".webm": "video/webm",
+}
+
+func init() {
+	for ext, kind := range containertypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, kind)
+		}
+	}
+}
+
+// detect returns the content type of file, whose data starts with
+// head: from -content-type, the -mimetypes files, strong magic, the
+// file extension, the other magic, or http.DetectContentType, in
+// that order
+func detect(file string, head []byte) (kind string) {
 	defer func() {
-		log.Debug.F("sniffContent: %x %s", head, kind)
+		log.Debug.Add("action", "detect", "file", file, "type", kind).F("head: %x", head[:min(len(head), 16)])
 	}()
-	if len(head) < minHeadLen {
-		return kindUnknown
+	if *contenttype != "" {
+		return *contenttype
+	}
+	ext := strings.ToLower(path.Ext(file))
+	if kind := exttypes[ext]; kind != "" {
+		return kind
+	}
+	for _, k := range kindTab {
+		if k.strong() && k.matches(head) {
+			return k.kind
+		}
+	}
+	if kind := mime.TypeByExtension(ext); kind != "" && kind != kindUnknown {
+		return kind
 	}
 	for _, k := range kindTab {
-		if string(head)[k.at:k.at+len(k.magic)] == k.magic {
+		if !k.strong() && k.matches(head) {
 			return k.kind
 		}
 	}
+	if len(head) > 0 {
+		return http.DetectContentType(head)
+	}
 	return kindUnknown
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sniffContent returns the content type of data with an unknown name
+func sniffContent(head []byte) string {
+	return detect("", head)
+}
+
+// headwriter holds back the first sniffLen bytes written to it until
+// the content type can be detected, then opens the destination with
+// them
+type headwriter struct {
+	head []byte
+	w    io.WriteCloser
+	err  error
+	open func(head []byte) (io.WriteCloser, error)
+}
+
+func (h *headwriter) Write(p []byte) (int, error) {
+	if h.err != nil {
+		return 0, h.err
+	}
+	if h.w != nil {
+		return h.w.Write(p)
+	}
+	h.head = append(h.head, p...)
+	if len(h.head) < sniffLen {
+		return len(p), nil
+	}
+	if err := h.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *headwriter) start() error {
+	if h.w, h.err = h.open(h.head); h.err != nil {
+		return h.err
+	}
+	if len(h.head) > 0 {
+		_, h.err = h.w.Write(h.head)
+	}
+	h.head = nil
+	return h.err
+}
+
+func (h *headwriter) Close() error {
+	if h.w == nil && h.err == nil {
+		h.start()
+	}
+	if h.err != nil {
+		if h.w != nil {
+			h.w.Close()
+		}
+		return h.err
+	}
+	return h.w.Close()
+}
+
+// Abort aborts the writer, if it was opened
+func (h *headwriter) Abort() error {
+	if h.w == nil {
+		h.err = errAborted
+		return nil
+	}
+	return abortw(h.w)
+}
+
+// readMimeTypes reads a mapping file. Lines are in the format of
+// mime.types (a content type followed by extensions), or add to the
+// magic table:
+//
+//	text/markdown md markdown
+//	magic application/x-foo 0 464f4f21
+//
+// where 0 is the offset of the hex encoded bytes.
+func readMimeTypes(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("mimetypes: %w", err)
+	}
+	defer fd.Close()
+	added := []magic{}
+	sc := bufio.NewScanner(fd)
+	for n := 1; sc.Scan(); n++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if f[0] == "magic" {
+			if len(f) != 4 {
+				return fmt.Errorf("mimetypes: %s:%d: want: magic type offset hex", file, n)
+			}
+			at, err := strconv.Atoi(f[2])
+			if err != nil || at < 0 {
+				return fmt.Errorf("mimetypes: %s:%d: bad offset: %q", file, n, f[2])
+			}
+			b, err := hex.DecodeString(f[3])
+			if err != nil || len(b) == 0 {
+				return fmt.Errorf("mimetypes: %s:%d: bad magic: %q", file, n, f[3])
+			}
+			added = append(added, magic{kind: f[1], at: at, magic: string(b)})
+			continue
+		}
+		for _, ext := range f[1:] {
+			exttypes["."+strings.ToLower(strings.TrimPrefix(strings.TrimSuffix(ext, ";"), "."))] = f[0]
+		}
+	}
+	// before the built in ones
+	kindTab = append(added, kindTab...)
+	return sc.Err()
+}
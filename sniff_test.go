@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	ts := bytes.Repeat(append([]byte{'G'}, make([]byte, tspacket-1)...), 3)
+	for _, tc := range []struct {
+		file string
+		head []byte
+		want string
+	}{
+		{"a.ts", ts, kindMPEG},
+		{"", ts, kindMPEG},
+		{"", []byte("Go is fun"), "text/plain; charset=utf-8"},
+		{"", append([]byte("G"), make([]byte, 400)...), kindUnknown},
+		{"a.png", []byte("\x89PNG\r\n\x1a\nxxxx"), kindPNG},
+		{"a.pdf", []byte("hello"), "application/pdf"},
+		{"a", []byte("\x28\xb5\x2f\xfdxx"), kindZSTD},
+		{"a.zip", []byte("PK\x03\x04xx"), kindZIP},
+		{"a.bin", []byte("PK\x03\x04xx"), kindZIP},
+		{"a.docx", []byte("PK\x03\x04xx"), containertypes[".docx"]},
+		{"a.jar", []byte("PK\x03\x04xx"), mime.TypeByExtension(".jar")},
+		{"a.webm", []byte("\x1a\x45\xdf\xa3xx"), "video/webm"},
+		{"a.txt", []byte("BZh is not a bzip2 file"), mime.TypeByExtension(".txt")},
+		{"a.txt", []byte("ID3 is not an mp3 file"), mime.TypeByExtension(".txt")},
+		{"a.txt", []byte("\x89PNG\r\n\x1a\nxxxx"), kindPNG},
+		{"a", []byte("BZh91AY&SY"), kindBZIP2},
+		{"a", []byte("\xff\xfb\x90\x00"), kindMP3},
+		{"", nil, kindUnknown},
+	} {
+		if have := detect(tc.file, tc.head); have != tc.want {
+			t.Errorf("detect(%q, %.8q): have %q want %q", tc.file, tc.head, have, tc.want)
+		}
+	}
+}
+
+func TestReadMimeTypes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "types")
+	os.WriteFile(file, []byte("# comment\ntext/markdown md .MARKDOWN\nmagic application/x-foo 2 464f4f21\n"), 0666)
+	defer func(ext map[string]string, tab []magic) { exttypes, kindTab = ext, tab }(exttypes, kindTab)
+	exttypes = map[string]string{}
+	if err := readMimeTypes(file); err != nil {
+		t.Fatal(err)
+	}
+	if have := detect("x.markdown", []byte("\x89PNG\r\n\x1a\n")); have != "text/markdown" {
+		t.Fatalf("extension: have %q", have)
+	}
+	if have := detect("x", []byte("..FOO!")); have != "application/x-foo" {
+		t.Fatalf("magic: have %q", have)
+	}
+	os.WriteFile(file, []byte("magic application/x-foo zz 00\n"), 0666)
+	if readMimeTypes(file) == nil {
+		t.Fatal("bad offset: no error")
+	}
+}
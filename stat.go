@@ -51,28 +51,6 @@ func (w tx) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
-type rxlim struct {
-	lim int
-	rx
-}
-
-func (r *rxlim) Read(p []byte) (n int, err error) {
-	rx := int(atomic.LoadInt64(&iostat.rx))
-	dur := int(time.Since(procstart) / (100 * time.Millisecond))
-	bpms := 0
-	if dur > 0 {
-		bpms = rx / dur
-	}
-	if bpms*10 > r.lim {
-		s := time.Duration((float64(bpms*10)/float64(r.lim) - 1) * float64(time.Second))
-		if s >= 100*time.Millisecond {
-			quantum()
-			time.Sleep(s)
-		}
-	}
-	return r.rx.Read(p)
-}
-
 // quantum releases the thread and prevents spinning in a loop
 // it sleeps for double the actual quantum on linux, which is 2*100ms
 func quantum() {
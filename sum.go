@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/as/log"
+)
+
+// hashtags are the names of the hashes in tagged (bsd style)
+// checksum lines, e.g.: SHA256 (file) = e3b0...
+var hashtags = map[string]string{
+	"md5":     "MD5",
+	"sha1":    "SHA1",
+	"sha256":  "SHA256",
+	"sha384":  "SHA384",
+	"sha512":  "SHA512",
+	"crc32c":  "CRC32C",
+	"blake2b": "BLAKE2b",
+	"xxhash":  "XXH64",
+}
+
+// hashbylen guesses the hash of an untagged checksum line from the
+// length of the digest; blake2b needs -hash blake2b
+var hashbylen = map[int]string{
+	8:   "crc32c",
+	16:  "xxhash",
+	32:  "md5",
+	40:  "sha1",
+	64:  "sha256",
+	96:  "sha384",
+	128: "sha512",
+}
+
+// remotesums returns the digests of file that its server stores, so
+// it does not have to be downloaded: the md5 of s3 objects uploaded
+// in one part, the md5 and crc32c of gs objects, and with -trustsum
+// the sha256 left by -storesum
+func remotesums(file string) map[string]string {
+	st, ok := driver[uri(file).Scheme].(stater)
+	switch uri(file).Scheme {
+	case "", "file":
+		// user.sha256 is no reason not to read a local file
+		ok = false
+	}
+	if !ok || !*remotesum {
+		return nil
+	}
+	a, err := st.Stat(file)
+	if err != nil {
+		log.Debug.Add("action", "stat", "file", file, "err", err).Printf("no remote checksums")
+		return nil
+	}
+	sum := map[string]string{}
+	etag := strings.Trim(a.ETag, `"`)
+	if a.MD5 != nil {
+		sum["md5"] = fmt.Sprintf("%x", a.MD5)
+	} else if len(etag) == 32 && !a.Opaque {
+		sum["md5"] = etag
+	}
+	if a.CRC32C != nil {
+		sum["crc32c"] = fmt.Sprintf("%08x", *a.CRC32C)
+	}
+	for k, v := range a.User {
+		// user metadata: set by anyone, and carried by copies
+		if *trustsum && strings.EqualFold(k, "sha256") {
+			sum["sha256"] = strings.ToLower(v)
+		}
+	}
+	return sum
+}
+
+// filesum returns the named digests of file. The ones the server
+// does not store are computed in one pass over the data.
+func filesum(file string, names []string) (map[string]string, error) {
+	sum := remotesums(file)
+	if sum == nil {
+		sum = map[string]string{}
+	}
+	need := []string{}
+	for _, name := range names {
+		if sum[name] == "" {
+			need = append(need, name)
+		}
+	}
+	line := log.Debug.Add("action", "sum", "file", file, "remote", len(names)-len(need))
+	if len(need) == 0 {
+		line.Printf("using remote checksums")
+		return sum, nil
+	}
+	fd, err := driver[uri(file).Scheme].Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	h := newMultihash(need...)
+	if _, err = io.Copy(h, rx{rxlimit(fd, file)}); err != nil {
+		return nil, err
+	}
+	for i, s := range h.sums() {
+		sum[need[i]] = s
+	}
+	line.Printf("computed checksums")
+	return sum, nil
+}
+
+// sumnames returns the hashes given by -hash, or sha256
+func sumnames() []string {
+	names, _ := hashlist(*hashname)
+	if len(names) == 0 {
+		names = []string{"sha256"}
+	}
+	return names
+}
+
+// dosum prints a checksum line for every file under src. With one
+// hash the lines are in the format of sha256sum and friends, with
+// several they are tagged (like sha256sum --tag).
+func dosum(src ...string) {
+	names := sumnames()
+	files := []Info{}
+	for _, src := range src {
+		if driver[uri(src).Scheme] == nil {
+			log.Fatal.F("src: scheme not supported: %s", src)
+		}
+		dir, err := find(src)
+		if err != nil {
+			log.Fatal.Add("action", "list", "src", src, "err", err).Printf("list error")
+		}
+		files = append(files, dir...)
+	}
+	lines := make([]chan string, len(files))
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	for i, f := range files {
+		i, file, name := i, f.String(), f.String()
+		if *rel {
+			name = f.Path
+		}
+		lines[i] = make(chan string, 1)
+		q.add(func() {
+			sum, err := filesum(file, names)
+			if err != nil {
+				log.Error.Add("action", "sum", "file", file, "err", err).Printf("checksum error")
+				lines[i] <- ""
+				return
+			}
+			s := ""
+			for _, h := range names {
+				if len(names) == 1 {
+					s += fmt.Sprintf("%s  %s\n", sum[h], name)
+				} else {
+					s += fmt.Sprintf("%s (%s) = %s\n", hashtags[h], name, sum[h])
+				}
+			}
+			lines[i] <- s
+		}, file)
+	}
+	q.run()
+
+	// in listing order, as soon as each one is known
+	for i := range lines {
+		s := <-lines[i]
+		if s == "" {
+			nerr++
+		}
+		fmt.Print(s)
+	}
+}
+
+// entry is a line of a checksum manifest
+type entry struct {
+	file string
+	want map[string]string
+}
+
+var (
+	taggedline = regexp.MustCompile(`^([A-Za-z0-9-]+) \((.*)\) = ([0-9a-fA-F]+)$`)
+	plainline  = regexp.MustCompile(`^\\?([0-9a-fA-F]+) [ *](.*)$`)
+)
+
+// readManifest parses the checksum lines in r. Untagged lines use
+// the hash given by -hash, or the one suggested by their length.
+func readManifest(r io.Reader) (list []*entry, err error) {
+	names, _ := hashlist(*hashname)
+	byfile := map[string]*entry{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		ln := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(ln) == "" || strings.HasPrefix(ln, "#") {
+			continue
+		}
+		algo, file, sum := "", "", ""
+		if m := taggedline.FindStringSubmatch(ln); m != nil {
+			tag := strings.TrimSuffix(strings.ToUpper(m[1]), "-512")
+			for k, v := range hashtags {
+				if strings.ToUpper(v) == tag {
+					algo = k
+				}
+			}
+			if algo == "" {
+				return nil, fmt.Errorf("manifest: line %d: unsupported hash: %s", n, m[1])
+			}
+			file, sum = m[2], m[3]
+		} else if m := plainline.FindStringSubmatch(ln); m != nil {
+			file, sum = m[2], m[1]
+			if len(names) == 1 {
+				algo = names[0]
+			} else {
+				algo = hashbylen[len(sum)]
+			}
+			if algo == "" {
+				return nil, fmt.Errorf("manifest: line %d: unknown hash with %d digits (see -hash)", n, len(sum))
+			}
+		} else {
+			return nil, fmt.Errorf("manifest: line %d: not a checksum line", n)
+		}
+		e := byfile[file]
+		if e == nil {
+			e = &entry{file: file, want: map[string]string{}}
+			byfile[file] = e
+			list = append(list, e)
+		}
+		e.want[algo] = strings.ToLower(sum)
+	}
+	return list, sc.Err()
+}
+
+// docheck verifies the files in the manifest, printing a line for
+// each like sha256sum -c. If root is not empty the files are found
+// under it (e.g., to check a copy of the tree the manifest was made
+// for).
+func docheck(manifest, root string) {
+	fd, err := driver[uri(manifest).Scheme].Open(manifest)
+	if err != nil {
+		log.Fatal.F("check: %v", err)
+	}
+	list, err := readManifest(fd)
+	fd.Close()
+	if err != nil {
+		log.Fatal.F("check: %s: %v", manifest, err)
+	}
+	lines := make([]chan string, len(list))
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	for i, e := range list {
+		i, e, file := i, e, e.file
+		if root != "" {
+			if strings.Contains(file, "://") {
+				file = uri(file).Path
+			}
+			file = strings.TrimSuffix(root, "/") + "/" + strings.TrimPrefix(file, "/")
+		}
+		lines[i] = make(chan string, 1)
+		q.add(func() {
+			names := []string{}
+			for name := range e.want {
+				names = append(names, name)
+			}
+			sum, err := filesum(file, names)
+			if err != nil {
+				log.Error.Add("action", "check", "file", file, "err", err).Printf("checksum error")
+				lines[i] <- fmt.Sprintf("%s: FAILED open or read\n", e.file)
+				return
+			}
+			for _, name := range names {
+				if sum[name] != e.want[name] {
+					log.Error.Add("action", "check", "file", file, "hash", name, "have", sum[name], "want", e.want[name]).Printf("checksum mismatch")
+					lines[i] <- fmt.Sprintf("%s: FAILED\n", e.file)
+					return
+				}
+			}
+			lines[i] <- fmt.Sprintf("%s: OK\n", e.file)
+		}, file)
+	}
+	q.run()
+	for i := range lines {
+		s := <-lines[i]
+		if !strings.HasSuffix(s, ": OK\n") {
+			nerr++
+		}
+		fmt.Print(s)
+	}
+	if nerr != 0 {
+		log.Error.Add("action", "check", "manifest", manifest, "failed", nerr, "total", len(list)).Printf("check failed")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	const manifest = `# made by hand
+900150983cd24fb0d6963f7d28e17f72  a
+BLAKE2b (b c) = ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923
+SHA256 (b c) = BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD
+364b3fb7 *s3://bucket/d
+`
+	list, err := readManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		file string
+		want map[string]string
+	}{
+		{"a", map[string]string{"md5": "900150983cd24fb0d6963f7d28e17f72"}},
+		{"b c", map[string]string{"blake2b": "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923", "sha256": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"}},
+		{"s3://bucket/d", map[string]string{"crc32c": "364b3fb7"}},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("have %d entries want %d", len(list), len(want))
+	}
+	for i, e := range list {
+		if e.file != want[i].file || len(e.want) != len(want[i].want) {
+			t.Fatalf("%d: have %+v want %+v", i, e, want[i])
+		}
+		for k, v := range want[i].want {
+			if e.want[k] != v {
+				t.Fatalf("%d: %s: have %s want %s", i, k, e.want[k], v)
+			}
+		}
+	}
+	if _, err := readManifest(strings.NewReader("nonsense\n")); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+// statfs is a bucket whose objects have attr
+type statfs struct {
+	prefixfs
+	attr Attr
+}
+
+func (s statfs) Stat(string) (Attr, error) { return s.attr, nil }
+
+func TestRemoteSums(t *testing.T) {
+	a := Attr{ETag: `"0cc175b9c0f1b6a831c399e269772661"`}
+	a.User = map[string]string{"sha256": "forged"}
+	s3 := driver["s3"]
+	driver["s3"] = statfs{attr: a}
+	defer func() { driver["s3"] = s3 }()
+
+	sum := remotesums("s3://b/k")
+	if sum["md5"] != "0cc175b9c0f1b6a831c399e269772661" || sum["sha256"] != "" {
+		t.Fatalf("have %q, want the md5 from the etag only", sum)
+	}
+	defer func() { *trustsum = false }()
+	*trustsum = true
+	if sum := remotesums("s3://b/k"); sum["sha256"] != "forged" {
+		t.Fatalf("-trustsum: have %q", sum)
+	}
+}
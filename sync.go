@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/as/log"
+)
+
+// mtimeslack is how far apart two modification times can be and still
+// match; some file systems keep whole seconds
+const mtimeslack = time.Second
+
+// treekey returns a key for u that is the same however a driver
+// spells its path
+func treekey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + "/" + strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+}
+
+// listtree lists the files under dir; a directory that does not
+// exist yet is empty
+func listtree(dir string) ([]Info, error) {
+	u := uri(dir)
+	switch u.Scheme {
+	case "s3", "gs":
+		// buckets list by prefix: s3://b/out would also list
+		// s3://b/output
+		if u.Path != "" && !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+			dir = u.String()
+		}
+	}
+	list, err := driver[u.Scheme].List(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	in := list[:0]
+	for _, f := range list {
+		if _, ok := inside(u.Path, f.Path); ok {
+			in = append(in, f)
+		}
+	}
+	return in, err
+}
+
+// syncplan returns the files in list (under root) that are missing or
+// different under dst, and the files under dst that are not in list
+func syncplan(root string, list []Info, dst string) (cp, stale []Info) {
+	have, err := listtree(dst)
+	if err != nil {
+		log.Fatal.Add("action", "list", "dst", dst, "err", err).Printf("list error")
+	}
+	byname := map[string]Info{}
+	for _, f := range have {
+		byname[treekey(f.URL)] = f
+	}
+	q, err := newQueue(*jobs, *jscheme)
+	if err != nil {
+		log.Fatal.F("%v", err)
+	}
+	why := make([]chan string, len(list))
+	for i, src := range list {
+		d := src2dst(root, src.String(), dst)
+		k := treekey(&d)
+		df, ok := byname[k]
+		delete(byname, k)
+		why[i] = make(chan string, 1)
+		if !ok {
+			why[i] <- "new"
+			continue
+		}
+		i, src := i, src
+		q.add(func() { why[i] <- differ(src, df) }, src.String(), df.String())
+	}
+	q.run()
+
+	n := map[string]int{}
+	for i, src := range list {
+		reason := <-why[i]
+		log.Debug.Add("action", "sync", "src", src.String(), "reason", reason).Printf("compared")
+		n[reason]++
+		if reason != "" {
+			cp = append(cp, src)
+		}
+	}
+	if *delextra && len(list) > 0 {
+		// an empty source is more likely a mistake than a wish
+		// for an empty destination
+		for _, f := range have {
+			// what the filters leave out is not touched
+			if _, ok := byname[treekey(f.URL)]; ok && keep(dst, f) {
+				stale = append(stale, f)
+			}
+		}
+	}
+	log.Info.Add("action", "sync", "src", root, "dst", dst, "new", n["new"], "same", n[""], "changed", len(cp)-n["new"], "stale", len(stale)).Printf("sync plan")
+	return cp, stale
+}
+
+// differ returns why dst is not a copy of src, or "" if it is. The
+// sizes have to match, and the checksums with -checksum. Otherwise,
+// the etags or the modification times do.
+func differ(src, dst Info) string {
+	if src.Size != dst.Size {
+		return "size"
+	}
+	s, d := src.String(), dst.String()
+	if *bysum {
+		same, err := samesum(s, d)
+		if err != nil {
+			return "checksum: " + err.Error()
+		}
+		if !same {
+			return "checksum"
+		}
+		return ""
+	}
+	// the listings carry the times, so most files need no request
+	if near(src.ModTime, dst.ModTime) {
+		return ""
+	}
+	sa, err := attrof(src)
+	if err != nil {
+		return "stat: " + err.Error()
+	}
+	da, err := attrof(dst)
+	if err != nil {
+		return "stat: " + err.Error()
+	}
+	if src.Scheme == dst.Scheme && sa.ETag != "" && sa.ETag == da.ETag {
+		return ""
+	}
+	if !near(sa.ModTime, da.ModTime) {
+		return "mtime"
+	}
+	return ""
+}
+
+// near reports whether the times are known and within mtimeslack
+func near(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return false
+	}
+	dt := a.Sub(b)
+	return dt <= mtimeslack && dt >= -mtimeslack
+}
+
+// attrof returns the attributes of f. A file's listing has its
+// modification time, but a bucket's only the time of the upload, so
+// only bucket objects and files listed without a time are stat'ed.
+func attrof(f Info) (Attr, error) {
+	switch f.Scheme {
+	case "s3", "gs":
+	default:
+		if !f.ModTime.IsZero() {
+			a := Attr{Size: int64(f.Size)}
+			a.ModTime = f.ModTime
+			return a, nil
+		}
+	}
+	return statattr(f.String())
+}
+
+// samesum reports whether src and dst have the same checksum, in
+// the hash commonsum picks for them
+func samesum(src, dst string) (bool, error) {
+	name := commonsum(src, dst)
+	ss, err := filesum(src, []string{name})
+	if err != nil {
+		return false, err
+	}
+	ds, err := filesum(dst, []string{name})
+	if err != nil {
+		return false, err
+	}
+	return ss[name] == ds[name], nil
+}
+
+// statattr returns the attributes of file
+func statattr(file string) (Attr, error) {
+	st, ok := driver[uri(file).Scheme].(stater)
+	if !ok {
+		return Attr{}, errors.New("scheme has no attributes")
+	}
+	return st.Stat(file)
+}
+
+// commonsum returns the hash to compare src and dst with: one that
+// both servers store, else one that either does, else the first of
+// -hash
+func commonsum(src, dst string) string {
+	s, d := remotesums(src), remotesums(dst)
+	for _, name := range []string{"sha256", "md5", "crc32c"} {
+		if s[name] != "" && d[name] != "" {
+			return name
+		}
+	}
+	for _, name := range []string{"sha256", "md5", "crc32c"} {
+		if s[name] != "" || d[name] != "" {
+			return name
+		}
+	}
+	return sumnames()[0]
+}
+
+// prune deletes the files under the destination of a sync that are
+// not in the source
+func prune(stale []Info) {
+	for _, f := range stale {
+		file := f.String()
+		line := log.Info.Add("action", "delete", "dst", file)
+		if err := driver[f.Scheme].Delete(file); err != nil {
+			line = log.Error.Add("action", "delete", "dst", file, "err", err)
+			nerr++
+		}
+		line.Printf("sync delete")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// prefixfs lists its keys by prefix, like s3 and gs
+type prefixfs []string
+
+func (b prefixfs) List(dir string) (list []Info, err error) {
+	u := uri(dir)
+	for _, k := range b {
+		if strings.HasPrefix(k, strings.TrimPrefix(u.Path, "/")) {
+			u := u
+			u.Path = k
+			list = append(list, Info{URL: &u, Size: 1})
+		}
+	}
+	return list, nil
+}
+
+func (b prefixfs) Delete(string) error                   { return errors.New("prefixfs: delete") }
+func (b prefixfs) Open(string) (io.ReadCloser, error)    { return nil, errors.New("prefixfs: open") }
+func (b prefixfs) Create(string) (io.WriteCloser, error) { return nil, errors.New("prefixfs: create") }
+func (b prefixfs) Close() error                          { return nil }
+
+// withbucket replaces the s3 driver with b until the test ends
+func withbucket(t *testing.T, b prefixfs) {
+	s3 := driver["s3"]
+	driver["s3"] = b
+	t.Cleanup(func() { driver["s3"] = s3 })
+}
+
+func TestListTreeSiblings(t *testing.T) {
+	withbucket(t, prefixfs{"out/a", "out/sub/b", "output/c", "out2/d", "out"})
+	for _, dir := range []string{"s3://b/out", "s3://b/out/"} {
+		list, err := listtree(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := []string{}
+		for _, f := range list {
+			have = append(have, f.Path)
+		}
+		if want := []string{"out/a", "out/sub/b"}; strings.Join(have, " ") != strings.Join(want, " ") {
+			t.Errorf("listtree(%q): have %q want %q", dir, have, want)
+		}
+	}
+
+	// -sync -delete must not prune the siblings
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0666)
+	src := uri(filepath.Join(dir, "a"))
+	defer func() { *delextra = false }()
+	*delextra = true
+	_, stale := syncplan(dir, []Info{{URL: &src, Size: 1}}, "s3://b/out")
+	have := []string{}
+	for _, f := range stale {
+		have = append(have, f.Path)
+	}
+	sort.Strings(have)
+	if want := "out/sub/b"; strings.Join(have, " ") != want {
+		t.Errorf("stale: have %q want %q", have, want)
+	}
+}
+
+func TestTreeKey(t *testing.T) {
+	a, b := uri("s3://bucket/dir/file"), uri("s3://bucket/x/../dir//file")
+	c := b
+	c.Path = "dir/file" // as listed
+	if treekey(&a) != treekey(&b) || treekey(&a) != treekey(&c) {
+		t.Fatalf("keys differ: %q %q %q", treekey(&a), treekey(&b), treekey(&c))
+	}
+}
+
+func TestDiffer(t *testing.T) {
+	dir := t.TempDir()
+	info := func(name, data string, mtime time.Time) Info {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(data), 0666)
+		os.Chtimes(file, mtime, mtime)
+		u := uri(file)
+		return Info{URL: &u, Size: len(data)}
+	}
+	now := time.Now()
+	src := info("src", "data", now)
+	for _, tc := range []struct {
+		dst  Info
+		want string
+	}{
+		{info("same", "data", now.Add(time.Second/2)), ""},
+		{info("long", "data2", now), "size"},
+		{info("old", "data", now.Add(-time.Hour)), "mtime"},
+	} {
+		if have := differ(src, tc.dst); have != tc.want {
+			t.Errorf("%s: have %q want %q", tc.dst, have, tc.want)
+		}
+	}
+	defer func() { *bysum = false }()
+	*bysum = true
+	if have := differ(src, info("old2", "data", now.Add(-time.Hour))); have != "" {
+		t.Errorf("checksum: have %q", have)
+	}
+	if have := differ(src, info("other", "atad", now)); have != "checksum" {
+		t.Errorf("checksum: have %q", have)
+	}
+}
+
+func TestDifferListing(t *testing.T) {
+	now := time.Now()
+	file := func(p string, mtime time.Time) Info {
+		return Info{URL: &url.URL{Path: p}, Size: 1, ModTime: mtime}
+	}
+	// the listing times match, so the missing files are not stat'ed
+	if have := differ(file("/nonexistent/a", now), file("/nonexistent/b", now)); have != "" {
+		t.Errorf("listing: have %q", have)
+	}
+
+	// a bucket lists the upload time; the stored mtime is stat'ed
+	a := Attr{Size: 1}
+	a.ModTime = now
+	s3 := driver["s3"]
+	driver["s3"] = statfs{attr: a}
+	defer func() { driver["s3"] = s3 }()
+	obj := Info{URL: &url.URL{Scheme: "s3", Host: "b", Path: "k"}, Size: 1, ModTime: now.Add(time.Hour)}
+	if have := differ(file("/nonexistent/a", now), obj); have != "" {
+		t.Errorf("bucket: have %q", have)
+	}
+	if have := differ(file("/nonexistent/a", now.Add(-time.Hour)), obj); have != "mtime" {
+		t.Errorf("bucket: have %q want mtime", have)
+	}
+}
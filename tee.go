@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/as/log"
+)
+
+// aborter is a writer that can be closed without committing what was
+// written to it
+type aborter interface {
+	Abort() error
+}
+
+var errAborted = errors.New("aborted")
+
+// abortw closes w without committing it: uploads are aborted (or kept
+// for -resume) and partial local files removed
+func abortw(w io.WriteCloser) error {
+	switch w := w.(type) {
+	case aborter:
+		return w.Abort()
+	case *os.File:
+		if w == os.Stdout {
+			return nil
+		}
+		w.Close()
+		return os.Remove(w.Name())
+	}
+	return w.Close()
+}
+
+// fanout writes to several destinations concurrently. A destination
+// that fails is dropped, and the copy continues as long as enough
+// destinations remain to satisfy the quorum.
+type fanout struct {
+	dst    []string
+	w      []io.WriteCloser
+	err    []error
+	closed []bool
+	need   int
+}
+
+func (f *fanout) alive() (n int) {
+	for _, err := range f.err {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fanout) each(fn func(i int) error) {
+	var wg sync.WaitGroup
+	for i := range f.w {
+		if f.err[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				f.err[i] = err
+				log.Error.Add("action", "tee", "dst", f.dst[i], "err", err).Printf("dropping destination")
+				f.abort(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	f.each(func(i int) error {
+		n, err := txlimit(f.w[i], f.dst[i]).Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err := f.quorum(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *fanout) Close() error {
+	f.each(func(i int) error {
+		if f.dst[i] == "-" {
+			return nil
+		}
+		err := f.w[i].Close()
+		f.closed[i] = err == nil
+		return err
+	})
+	return f.quorum()
+}
+
+// abort aborts the ith destination unless it was committed
+func (f *fanout) abort(i int) {
+	if f.w[i] == nil || f.closed[i] || f.dst[i] == "-" {
+		return
+	}
+	if err := abortw(f.w[i]); err != nil {
+		log.Warn.Add("action", "tee", "dst", f.dst[i], "err", err).Printf("abort failed")
+	}
+	f.closed[i] = true
+}
+
+// abortall aborts the destinations that are still open
+func (f *fanout) abortall() {
+	for i := range f.w {
+		f.abort(i)
+	}
+}
+
+func (f *fanout) quorum() error {
+	if n := f.alive(); n < f.need {
+		return fmt.Errorf("tee: %d of %d destinations failed, need %d: %s", len(f.w)-n, len(f.w), f.need, f.failed())
+	}
+	return nil
+}
+
+func (f *fanout) failed() string {
+	s := []string{}
+	for i, err := range f.err {
+		if err != nil {
+			s = append(s, fmt.Sprintf("%s: %v", f.dst[i], err))
+		}
+	}
+	return strings.Join(s, "; ")
+}
+
+// doteecp reads src once and writes it to every dst. Each destination
+// is reported separately; the copy fails if fewer than -quorum
+// destinations (all of them by default) succeed.
+func doteecp(src string, dst []string, ec chan<- work) {
+	w := work{src: src, dst: strings.Join(dst, ",")}
+	sfd, err := driver[uri(src).Scheme].Open(src)
+	if err != nil {
+		w.err = fmt.Errorf("open src: %s: %w", src, err)
+		ec <- w
+		return
+	}
+	defer sfd.Close()
+
+	f := &fanout{dst: dst, w: make([]io.WriteCloser, len(dst)), err: make([]error, len(dst)), closed: make([]bool, len(dst)), need: len(dst)}
+	if *quorum > 0 && *quorum < len(dst) {
+		f.need = *quorum
+	}
+	meta := carrier(src)
+	var wg sync.WaitGroup
+	for i := range dst {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f.w[i], f.err[i] = create(dst[i], meta)
+			if f.err[i] != nil {
+				f.err[i] = fmt.Errorf("create dst: %w", f.err[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	in := rxlimit(sfd, src)
+	var dg *digest
+	if *verifycp {
+		dw := make([]io.Writer, len(f.w))
+		for i := range f.w {
+			dw[i] = f.w[i]
+		}
+		dg = newDigest(dw...)
+		in = io.TeeReader(in, dg)
+	}
+	if err = f.quorum(); err == nil && !*test {
+		_, w.sum, err = copyhash(f, in)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil && !*test {
+		err = checksum(w.sum)
+	}
+	if err == nil && dg != nil && !*test {
+		f.each(func(i int) error {
+			return verify(dst[i], f.w[i], dg, listed(src))
+		})
+		err = f.quorum()
+	}
+	if err != nil {
+		// e.g., the quorum failed: nothing that is still open is
+		// committed
+		f.abortall()
+	}
+	for i, dst := range dst {
+		line := log.Info.Add("action", "tee", "src", src, "dst", dst, "status", "done")
+		if f.err[i] != nil {
+			line = log.Error.Add("action", "tee", "src", src, "dst", dst, "status", "failed", "err", f.err[i])
+		}
+		line.Printf("")
+	}
+	w.err = err
+	ec <- w
+}
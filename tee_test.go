@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failw is a destination that fails after some writes
+type failw struct {
+	left          int
+	closed, abort *bool
+}
+
+func (w *failw) Write(p []byte) (int, error) {
+	if w.left--; w.left < 0 {
+		return 0, errors.New("failw: write")
+	}
+	return len(p), nil
+}
+func (w *failw) Close() error { *w.closed = true; return nil }
+func (w *failw) Abort() error { *w.abort = true; return nil }
+
+// failfs creates failw destinations
+type failfs struct {
+	prefixfs
+	left          int
+	closed, abort *bool
+}
+
+func (f failfs) Create(string) (io.WriteCloser, error) {
+	return &failw{left: f.left, closed: f.closed, abort: f.abort}, nil
+}
+
+func TestTeeQuorum(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	os.WriteFile(src, []byte("data"), 0666)
+	defer func(q int) { *quorum = q }(*quorum)
+
+	for _, tc := range []struct {
+		quorum int
+		ok     bool
+	}{{2, true}, {0, false}} {
+		closed, aborted := false, false
+		driver["fail"] = failfs{closed: &closed, abort: &aborted}
+		defer delete(driver, "fail")
+		*quorum = tc.quorum
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		os.Remove(a)
+		os.Remove(b)
+
+		ec := make(chan work, 1)
+		doteecp(src, []string{a, b, "fail://x/y"}, ec)
+		w := <-ec
+		if (w.err == nil) != tc.ok {
+			t.Fatalf("quorum %d: err: %v", tc.quorum, w.err)
+		}
+		if !aborted || closed {
+			t.Errorf("quorum %d: failed destination: aborted %v closed %v, want aborted", tc.quorum, aborted, closed)
+		}
+		for _, file := range []string{a, b} {
+			data, err := os.ReadFile(file)
+			if tc.ok && string(data) != "data" {
+				t.Errorf("quorum %d: %s: have %q, %v", tc.quorum, file, data, err)
+			}
+			if !tc.ok && err == nil {
+				t.Errorf("quorum %d: %s: partial copy was not removed", tc.quorum, file)
+			}
+		}
+	}
+}
+
+func TestTeeCreateQuorum(t *testing.T) {
+	// the destinations opened before the quorum failed are aborted
+	f := &fanout{dst: []string{"a", "b", "c"}, need: 3, closed: make([]bool, 3)}
+	closed, aborted := false, false
+	f.w = []io.WriteCloser{&failw{left: 1, closed: &closed, abort: &aborted}, nil, nil}
+	f.err = []error{nil, errors.New("create"), errors.New("create")}
+	if err := f.quorum(); err == nil {
+		t.Fatal("want quorum error")
+	}
+	f.abortall()
+	if !aborted || closed {
+		t.Fatalf("aborted %v closed %v, want aborted", aborted, closed)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/as/log"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+// upsema limits the concurrent upload requests like sema limits the
+// http block downloads. Both shrink when servers throttle ccp and grow
+// back as requests succeed.
+var upsema = newAIMD("upload", maxupload)
+
+// maxupload is the upload concurrency when nothing is throttled
+const maxupload = 16
+
+// aimd is a semaphore whose size adapts to throttling: it is halved
+// when a server asks to slow down (at most once per second, since
+// every request in flight tends to be throttled at once) and grows by
+// one after about size successful requests
+type aimd struct {
+	sync.Mutex
+	cond  *sync.Cond
+	name  string
+	max   int
+	size  float64
+	busy  int
+	until time.Time // no new requests before this (see Retry-After)
+	last  time.Time // last decrease
+}
+
+func newAIMD(name string, max int) *aimd {
+	if max < 1 {
+		max = 1
+	}
+	a := &aimd{name: name, max: max, size: float64(max)}
+	a.cond = sync.NewCond(a)
+	return a
+}
+
+func (a *aimd) acquire() {
+	a.Lock()
+	defer a.Unlock()
+	for a.busy >= int(a.size) || time.Now().Before(a.until) {
+		a.cond.Wait()
+	}
+	a.busy++
+}
+
+func (a *aimd) release() {
+	a.Lock()
+	a.busy--
+	a.Unlock()
+	a.cond.Broadcast()
+}
+
+// limit returns the current size
+func (a *aimd) limit() int {
+	a.Lock()
+	defer a.Unlock()
+	return int(a.size)
+}
+
+// ok records a request that was not throttled
+func (a *aimd) ok() {
+	a.Lock()
+	n := int(a.size)
+	if a.size += 1 / a.size; a.size > float64(a.max) {
+		a.size = float64(a.max)
+	}
+	grew := int(a.size) > n
+	a.Unlock()
+	if grew {
+		log.Debug.F("%s: concurrency %d", a.name, n+1)
+		a.cond.Broadcast()
+	}
+}
+
+// throttle records a throttled request; no new requests are made
+// until after has passed
+func (a *aimd) throttle(after time.Duration) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	if now.Sub(a.last) > time.Second {
+		a.last = now
+		if a.size /= 2; a.size < 1 {
+			a.size = 1
+		}
+		log.Warn.Add("action", "throttle", "concurrency", int(a.size), "retryafter", after).Printf("%s: throttled by server", a.name)
+	}
+	if t := now.Add(after); t.After(a.until) {
+		a.until = t
+		time.AfterFunc(after, a.cond.Broadcast)
+	}
+}
+
+// errThrottled is a response that asks the client to slow down
+type errThrottled struct {
+	status string
+	after  time.Duration
+}
+
+func (e *errThrottled) Error() string {
+	return fmt.Sprintf("throttled: %s", e.status)
+}
+
+// throttled returns an *errThrottled if resp is a 429 or 503
+func throttled(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return &errThrottled{status: resp.Status, after: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+// retryAfter parses a Retry-After header, which is either
+// a number of seconds or a date
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isThrottle reports whether err is a throttling error from http,
+// s3 (SlowDown and the other throttling codes) or gs, and for how
+// long the server asked to wait
+func isThrottle(err error) (time.Duration, bool) {
+	var (
+		te *errThrottled
+		ge *googleapi.Error
+		re awserr.RequestFailure
+	)
+	switch {
+	case err == nil:
+		return 0, false
+	case errors.As(err, &te):
+		return te.after, true
+	case errors.As(err, &ge):
+		return retryAfter(ge.Header.Get("Retry-After")), ge.Code == 429 || ge.Code == 503
+	case errors.As(err, &re):
+		if re.Code() == "SlowDown" || request.IsErrorThrottle(re) {
+			return 0, true
+		}
+		return 0, re.StatusCode() == 429 || re.StatusCode() == 503
+	}
+	return 0, false
+}
+
+// backoff returns how long to wait before the given retry. Throttled
+// requests wait as long as the server asked, or back off exponentially
+// with jitter; other errors wait one second per attempt.
+func backoff(attempt int, err error) time.Duration {
+	after, ok := isThrottle(err)
+	if !ok {
+		return time.Duration(attempt) * time.Second
+	}
+	if after > 0 {
+		return after
+	}
+	if attempt > 5 {
+		attempt = 5
+	}
+	d := time.Second << uint(attempt)
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)))
+}
+
+// s3parts makes the requests of an s3 uploader that send data wait
+// for upsema, so uploads slow down when throttled after they started.
+// The uploader runs up to maxupload of them.
+func s3parts(r *request.Request) {
+	switch r.Operation.Name {
+	case "UploadPart", "PutObject":
+	default:
+		return
+	}
+	// every attempt, retries included, holds a slot while it sends
+	r.Handlers.Send.PushFront(func(*request.Request) { upsema.acquire() })
+	r.Handlers.CompleteAttempt.PushBack(func(*request.Request) { upsema.release() })
+}
+
+// s3feedback reports the outcome of every s3 request to upsema;
+// it runs before each retry and when the request completes
+func s3feedback(r *request.Request) {
+	after := time.Duration(0)
+	if r.HTTPResponse != nil {
+		after = retryAfter(r.HTTPResponse.Header.Get("Retry-After"))
+	}
+	if _, ok := isThrottle(r.Error); ok {
+		upsema.throttle(after)
+	} else if r.Error == nil {
+		upsema.ok()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"google.golang.org/api/googleapi"
+)
+
+func TestAIMD(t *testing.T) {
+	a := newAIMD("test", 8)
+	a.throttle(0)
+	if n := a.limit(); n != 4 {
+		t.Fatalf("throttled: have %d want 4", n)
+	}
+	a.throttle(0) // within a second of the last decrease
+	if n := a.limit(); n != 4 {
+		t.Fatalf("throttled again: have %d want 4", n)
+	}
+	// it grows by one after about size successful requests
+	for i := 0; i < 4; i++ {
+		a.ok()
+	}
+	if n := a.limit(); n != 4 {
+		t.Fatalf("after 4 ok: have %d want 4", n)
+	}
+	a.ok()
+	if n := a.limit(); n != 5 {
+		t.Fatalf("after 5 ok: have %d want 5", n)
+	}
+	for i := 0; i < 100; i++ {
+		a.ok()
+	}
+	if n := a.limit(); n != 8 {
+		t.Fatalf("max: have %d want 8", n)
+	}
+
+	// a full semaphore blocks until a release
+	a = newAIMD("test", 1)
+	a.acquire()
+	got := make(chan bool)
+	go func() {
+		a.acquire()
+		close(got)
+	}()
+	select {
+	case <-got:
+		t.Fatal("acquired a full semaphore")
+	case <-time.After(20 * time.Millisecond):
+	}
+	a.release()
+	<-got
+}
+
+func TestAIMDRetryAfter(t *testing.T) {
+	a := newAIMD("test", 1)
+	a.throttle(50 * time.Millisecond)
+	t0 := time.Now()
+	a.acquire()
+	if dt := time.Since(t0); dt < 40*time.Millisecond {
+		t.Fatalf("acquired after %v, want the retry-after", dt)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	for v, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"soon":                          0,
+		"Mon, 02 Jan 2006 15:04:05 GMT": 0,
+	} {
+		if have := retryAfter(v); have != want {
+			t.Errorf("retryAfter(%q): have %v want %v", v, have, want)
+		}
+	}
+	if d := retryAfter(future); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("retryAfter(%q): have %v", future, d)
+	}
+}
+
+func TestIsThrottle(t *testing.T) {
+	h := http.Header{}
+	h.Set("Retry-After", "2")
+	for _, tc := range []struct {
+		err   error
+		after time.Duration
+		ok    bool
+	}{
+		{nil, 0, false},
+		{errors.New("eof"), 0, false},
+		{&errThrottled{after: time.Second}, time.Second, true},
+		{fmt.Errorf("block: %w", &errThrottled{}), 0, true},
+		{&googleapi.Error{Code: 429, Header: h}, 2 * time.Second, true},
+		{&googleapi.Error{Code: 404, Header: h}, 2 * time.Second, false},
+		{awserr.NewRequestFailure(awserr.New("SlowDown", "", nil), 503, ""), 0, true},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "", nil), 503, ""), 0, true},
+		{awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, ""), 0, false},
+	} {
+		after, ok := isThrottle(tc.err)
+		if after != tc.after || ok != tc.ok {
+			t.Errorf("isThrottle(%v): have %v, %v want %v, %v", tc.err, after, ok, tc.after, tc.ok)
+		}
+	}
+}
+
+func TestS3Parts(t *testing.T) {
+	defer func(a *aimd) { upsema = a }(upsema)
+	upsema = newAIMD("test", 4)
+	busy := func() int {
+		upsema.Lock()
+		defer upsema.Unlock()
+		return upsema.busy
+	}
+	for op, want := range map[string]int{"UploadPart": 1, "PutObject": 1, "ListObjectsV2": 0} {
+		r := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: op}, nil, nil)
+		s3parts(r)
+		r.Handlers.Send.Run(r)
+		if have := busy(); have != want {
+			t.Errorf("%s: sending holds %d slots, want %d", op, have, want)
+		}
+		r.Handlers.CompleteAttempt.Run(r)
+		if have := busy(); have != 0 {
+			t.Errorf("%s: done holds %d slots", op, have)
+		}
+	}
+}
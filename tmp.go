@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/as/log"
+)
+
+// tmpmu serializes block placement so that concurrent blocks
+// see each others preallocated space when they query free space
+var tmpmu sync.Mutex
+
+// inittemps warns about temporary directories that live in memory
+func inittemps() {
+	for _, dir := range temps {
+		if isTmpfs(dir) {
+			log.Warn.Add("tmp", dir).Printf("temporary directory is tmpfs, disk blocks will use memory (see -maxmem)")
+		}
+	}
+}
+
+// errTempFull is returned for a disk block when every temporary
+// directory is down to -tmpreserve
+var errTempFull = errors.New("temporary space low")
+
+// placetemp returns the temporary directory with the most free space
+// for a block of the given size, or errTempFull if none of them has
+// room to spare (see -tmpreserve). The block then waits without
+// holding tmpmu (see auto). The caller must hold tmpmu.
+func placetemp(n, size int) (string, error) {
+	best, most := "", int64(-1)
+	for _, dir := range temps {
+		free, ok := freespace(dir)
+		if !ok {
+			// unknown, so round robin like before
+			return temps[atomic.AddInt64(&tmpctr, +1)%int64(len(temps))], nil
+		}
+		if free > most {
+			best, most = dir, free
+		}
+	}
+	if most-int64(size) < int64(*tmpreserve)*1024*1024 {
+		return "", errTempFull
+	}
+	return best, nil
+}
+
+var (
+	// tempname matches the temporary files of makedisk. They are
+	// locked while in use (see locktemp).
+	tempname = regexp.MustCompile(`^ccp([0-9]+)\.[0-9]+-[0-9]{4,}$`)
+
+	// tempgrace keeps the files of other processes that were just
+	// created, and are not locked yet
+	tempgrace = time.Minute
+	gconce    sync.Once
+)
+
+func tempfile(n int) string {
+	return fmt.Sprintf("ccp%d.*-%04d", os.Getpid(), n)
+}
+
+// gctemps removes the orphaned temporary files in dirs: the ones no
+// process holds a lock on. Pids are no proof, /tmp may be shared by
+// pid namespaces.
+func gctemps(dirs ...string) {
+	if *nogc {
+		return
+	}
+	for _, dir := range dirs {
+		list, _ := os.ReadDir(dir)
+		for _, e := range list {
+			if e.IsDir() || !tempname.MatchString(e.Name()) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil || time.Since(fi.ModTime()) < tempgrace {
+				continue
+			}
+			file := filepath.Join(dir, e.Name())
+			if !unlocked(file) {
+				continue
+			}
+			if err := os.Remove(file); err == nil {
+				log.Info.Add("file", file).Printf("removed orphaned temporary file")
+			}
+		}
+	}
+}
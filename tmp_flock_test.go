@@ -0,0 +1,38 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGCTemps(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	create := func(name string, mtime time.Time) *os.File {
+		fd, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fd.Name(), mtime, mtime)
+		return fd
+	}
+	create("ccp1.123-0001", old).Close() // orphaned
+	create("ccp2.123-0001", time.Now()).Close()
+	create("other", old).Close()
+	locked := create("ccp3.123-0001", old)
+	defer locked.Close()
+	if err := locktemp(locked); err != nil {
+		t.Fatal(err)
+	}
+	gctemps(dir)
+	for name, want := range map[string]bool{"ccp1.123-0001": false, "ccp2.123-0001": true, "other": true, "ccp3.123-0001": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s: exists: have %v want %v", name, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const tmpfsMagic = 0x01021994
+
+// freespace returns the bytes available to us in dir
+func freespace(dir string) (int64, bool) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+func isTmpfs(dir string) bool {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return st.Type == tmpfsMagic
+}
+
+// preallocate reserves size bytes for fd without changing its
+// length, so readers still see EOF where the writer is
+func preallocate(fd *os.File, size int) error {
+	const keepSize = 0x1 // FALLOC_FL_KEEP_SIZE
+	err := syscall.Fallocate(int(fd.Fd()), keepSize, 0, int64(size))
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPlaceTempFull(t *testing.T) {
+	defer func(t0 []string, r int) { temps, *tmpreserve = t0, r }(temps, *tmpreserve)
+	temps = []string{t.TempDir()}
+	*tmpreserve = 1 << 40 // MiB
+	if _, err := placetemp(0, 1); err != errTempFull {
+		t.Fatalf("have %v, want %v", err, errTempFull)
+	}
+	*tmpreserve = 0
+	if dir, err := placetemp(0, 1); err != nil || dir != temps[0] {
+		t.Fatalf("have %q, %v", dir, err)
+	}
+}
+
+func TestAutoWaitsForSpace(t *testing.T) {
+	defer func(t0 []string, r, m int) { temps, *tmpreserve, *maxmem = t0, r, m }(temps, *tmpreserve, *maxmem)
+	temps = []string{t.TempDir()}
+	*tmpreserve = 1 << 40 // MiB
+	mem.Lock()
+	*maxmem = mem.used // nothing left
+	mem.Unlock()
+
+	if err := newstore(0, 1, nil).Init(); !errors.Is(err, errTempFull) {
+		t.Fatalf("without want: have %v want %v", err, errTempFull)
+	}
+
+	// the block the reader waits for goes over the budget, once
+	next := newstore(0, 1, func() bool { return true })
+	if err := next.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := next.(*auto).Store.(*Block); !ok {
+		t.Fatalf("have %T, want a memory block", next.(*auto).Store)
+	}
+	done := make(chan error)
+	for i := 1; i <= 2; i++ {
+		s := newstore(i, 1, func() bool { return true })
+		defer s.Close()
+		go func() { done <- s.Init() }()
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("went over the budget twice: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// freeing the block lets one through, and disk space the other
+	next.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("went over the budget twice: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tmpmu.Lock()
+	*tmpreserve = 0
+	tmpmu.Unlock()
+	freed()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
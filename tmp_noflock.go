@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import "os"
+
+func locktemp(fd *os.File) error { return nil }
+
+// unlocked always reports false: without flock there is no telling
+// a file in use from an orphan, so no temporary files are removed
+func unlocked(file string) bool { return false }
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+func freespace(dir string) (int64, bool) { return 0, false }
+
+func isTmpfs(dir string) bool { return false }
+
+func preallocate(fd *os.File, size int) error { return nil }
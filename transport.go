@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/as/log"
+)
+
+// newTransport returns a transport configured by the connection
+// flags. Every http client uses one: the http driver, presigned
+// bucket reads, hedges, and the s3 and gs clients.
+func newTransport() *http.Transport {
+	d, _ := getdialer()
+	idle := *idleconns
+	if idle <= 0 {
+		idle = *maxhttp
+	}
+	t := &http.Transport{
+		Proxy:                 proxyfn,
+		DialContext:           d.DialContext,
+		MaxIdleConnsPerHost:   idle,
+		MaxConnsPerHost:       *maxconns,
+		IdleConnTimeout:       *idletimeout,
+		TLSHandshakeTimeout:   *tlstimeout,
+		ResponseHeaderTimeout: *headertimeout,
+		ExpectContinueTimeout: time.Second,
+		ReadBufferSize:        *rbuf * 1024,
+		WriteBufferSize:       *wbuf * 1024,
+		TLSClientConfig:       tlsbase.Clone(),
+		ForceAttemptHTTP2:     true,
+	}
+	h2config(t)
+	if *tlscache > 0 {
+		t.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(*tlscache)
+	}
+	if *http1 {
+		log.Debug.Printf("bootstrap: disable http2 completely")
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// inittransport installs the transports; it runs once the flags
+// are parsed
+func inittransport() {
+	if _, err := getdialer(); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	var err error
+	if proxyfn, err = newProxy(*proxy, *noproxy); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	if tlsbase, err = newTLS(*cacert, *cert, *key); err != nil {
+		log.Fatal.F("%v", err)
+	}
+	http.DefaultClient.Transport = newTransport()
+
+	// hedges never reuse connections so a hedge does not land on
+	// the connection of the straggler
+	t := newTransport()
+	t.DisableKeepAlives = true
+	hedgeClient.Transport = t
+}
+
+// proxyfn and tlsbase are the proxy and tls settings of every
+// transport (see -proxy, -noproxy, -cacert, -cert and -key)
+var (
+	proxyfn = http.ProxyFromEnvironment
+	tlsbase = &tls.Config{}
+)
+
+// newProxy returns a proxy function that sends every request through
+// proxy (or the proxy named by HTTP_PROXY and HTTPS_PROXY if it is
+// empty) except the ones to hosts in noproxy
+func newProxy(proxy, noproxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" && noproxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	var fixed *url.URL
+	if proxy != "" {
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy: scheme not supported: %s (want http, https, socks5 or socks5h)", u.Scheme)
+		}
+		fixed = u
+	}
+	skip := strings.Split(noproxy, ",")
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass(skip, req.URL.Host) {
+			return nil, nil
+		}
+		if fixed != nil {
+			return fixed, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}, nil
+}
+
+// bypass reports whether host matches the noproxy list. An entry is
+// "*", a domain (which matches its subdomains too), an ip address or
+// a cidr block, optionally with a port.
+func bypass(noproxy []string, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	ip := net.ParseIP(host)
+	for _, e := range noproxy {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if e == "*" {
+			return true
+		}
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			if p != port {
+				continue
+			}
+			e = h
+		}
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if eip := net.ParseIP(e); eip != nil {
+			if ip != nil && ip.Equal(eip) {
+				return true
+			}
+			continue
+		}
+		e = strings.TrimPrefix(e, ".")
+		host := strings.ToLower(host)
+		if host == e || strings.HasSuffix(host, "."+e) {
+			return true
+		}
+	}
+	return false
+}
+
+// newTLS returns the tls settings with the certificates in the
+// comma separated cacert files trusted in addition to the system
+// ones, and the client certificate in cert and key (key may be
+// empty if cert contains both)
+func newTLS(cacert, cert, key string) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if cacert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range strings.Split(cacert, ",") {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("cacert: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("cacert: %s: no certificates found", file)
+			}
+		}
+		conf.RootCAs = pool
+	}
+	if key != "" && cert == "" {
+		return nil, fmt.Errorf("key: no -cert given")
+	}
+	if cert != "" {
+		if key == "" {
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("cert: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
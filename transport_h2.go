@@ -0,0 +1,14 @@
+//go:build go1.26
+
+package main
+
+import "net/http"
+
+// h2config applies -h2strict, -h2window and -h2ping to t
+func h2config(t *http.Transport) {
+	t.HTTP2 = &http.HTTP2Config{
+		StrictMaxConcurrentRequests: *h2strict,
+		MaxReceiveBufferPerStream:   *h2window * 1024,
+		SendPingTimeout:             *h2ping,
+	}
+}
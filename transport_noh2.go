@@ -0,0 +1,22 @@
+//go:build !go1.26
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/as/log"
+)
+
+var h2warn sync.Once
+
+// h2config warns that -h2strict, -h2window and -h2ping need a
+// binary built with go1.26 or later
+func h2config(t *http.Transport) {
+	if *h2strict || *h2window != 0 || *h2ping != 0 {
+		h2warn.Do(func() {
+			log.Warn.Printf("http2: -h2strict, -h2window and -h2ping are ignored, ccp was built with a go older than 1.26")
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBypass(t *testing.T) {
+	skip := strings.Split("example.com, .internal,10.0.0.0/8,192.0.2.1,artifacts:8443", ",")
+	for host, want := range map[string]bool{
+		"example.com":        true,
+		"cdn.example.com:80": true,
+		"badexample.com":     false,
+		"svc.internal":       true,
+		"10.1.2.3:9000":      true,
+		"11.1.2.3":           false,
+		"192.0.2.1:443":      true,
+		"artifacts:8443":     true,
+		"artifacts:443":      false,
+		"s3.amazonaws.com":   false,
+	} {
+		if have := bypass(skip, host); have != want {
+			t.Errorf("%s: have %v want %v", host, have, want)
+		}
+	}
+	if !bypass([]string{"*"}, "anything:1") {
+		t.Errorf("*: want bypass")
+	}
+}
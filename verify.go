@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/as/log"
+)
+
+// Attr is what a driver reports about a stored object (see -verify)
+type Attr struct {
+	Size   int64
+	ETag   string // s3 only
+	Opaque bool   // the etag is not derived from md5 (e.g., sse-kms)
+	MD5    []byte
+	CRC32C *uint32
+	Meta
+}
+
+type stater interface {
+	Stat(file string) (Attr, error)
+}
+
+type partsizer interface {
+	Partsize() int64
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sizes of the sources in the listing, keyed by url
+var listsize = sync.Map{}
+
+func setlisted(src Info) {
+	if *verifycp && src.Size > 0 {
+		listsize.Store(src.String(), src.Size)
+	}
+}
+
+// listed returns the size of src in the listing, or zero
+func listed(src string) int {
+	n, _ := listsize.Load(src)
+	size, _ := n.(int)
+	return size
+}
+
+// digest hashes the data sent to one or more destinations so the
+// copies can be compared to what their providers report. For
+// destinations that upload in parts it also keeps the md5 of each
+// part, which s3 combines into the etag of a multipart upload.
+type digest struct {
+	n     int64
+	md5   hash.Hash
+	sha   hash.Hash
+	crc   hash.Hash32
+	dst   []io.Writer
+	parts map[int64]*parts
+}
+
+type parts struct {
+	h   hash.Hash
+	n   int64
+	sum []byte // concatenated md5 of every full part
+	k   int    // number of parts
+}
+
+func newDigest(dst ...io.Writer) *digest {
+	return &digest{
+		md5: md5.New(),
+		sha: sha256.New(),
+		crc: crc32.New(castagnoli),
+		dst: dst,
+	}
+}
+
+// partsof returns the part size dst uploads in, or zero
+func partsof(dst io.Writer) int64 {
+	if p, ok := dst.(partsizer); ok {
+		return p.Partsize()
+	}
+	return 0
+}
+
+func (d *digest) Write(p []byte) (int, error) {
+	if d.parts == nil {
+		// part sizes are known once the destinations resumed,
+		// which is before the first byte is written
+		d.parts = map[int64]*parts{}
+		for _, w := range d.dst {
+			if ps := partsof(w); ps > 0 {
+				d.parts[ps] = &parts{h: md5.New()}
+			}
+		}
+	}
+	d.n += int64(len(p))
+	d.md5.Write(p)
+	d.sha.Write(p)
+	d.crc.Write(p)
+	for ps, pt := range d.parts {
+		for q := p; len(q) > 0; {
+			k := ps - pt.n
+			if k > int64(len(q)) {
+				k = int64(len(q))
+			}
+			pt.h.Write(q[:k])
+			pt.n += k
+			q = q[k:]
+			if pt.n == ps {
+				pt.sum = pt.h.Sum(pt.sum)
+				pt.k++
+				pt.h.Reset()
+				pt.n = 0
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (d *digest) sha256() string {
+	return hex.EncodeToString(d.sha.Sum(nil))
+}
+
+// etag returns the s3 etag of the data uploaded in n parts of size
+// ps, or ok == false if that is not how the data was split
+func (d *digest) etag(ps int64, n int) (etag string, ok bool) {
+	if n == 0 {
+		return hex.EncodeToString(d.md5.Sum(nil)), true
+	}
+	pt := d.parts[ps]
+	if pt == nil {
+		return "", false
+	}
+	sum, k := pt.sum, pt.k
+	if pt.n > 0 {
+		sum, k = pt.h.Sum(sum), k+1
+	}
+	if k != n {
+		return "", false
+	}
+	all := md5.Sum(sum)
+	return fmt.Sprintf("%x-%d", all, k), true
+}
+
+// verify compares the copy in dst with the digest of the data that
+// was sent and with size, the size of the source in the listing
+// (if known). A local dst is read again and hashed.
+func verify(dst string, w io.Writer, d *digest, size int) error {
+	if dst == "-" || *appendonly {
+		return nil
+	}
+	line := log.Info.Add("action", "verify", "dst", dst, "size", d.n)
+	if size > 0 && *seek == 0 && *count == 0 && int64(size) != d.n {
+		return fmt.Errorf("verify: %s: copied %d bytes but the source was listed with %d", dst, d.n, size)
+	}
+	checked := []string{}
+	switch uri(dst).Scheme {
+	case "", "file":
+		fd, err := os.Open(uri(dst).Path)
+		if err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("verify: %s: %w", dst, err)
+		}
+		if n != d.n {
+			return fmt.Errorf("verify: %s: has %d bytes, sent %d", dst, n, d.n)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != d.sha256() {
+			return fmt.Errorf("verify: %s: sha256 mismatch: have %s sent %s", dst, sum, d.sha256())
+		}
+		checked = append(checked, "size", "sha256")
+	default:
+		st, ok := driver[uri(dst).Scheme].(stater)
+		if !ok {
+			line.Printf("verify: scheme can not be verified")
+			return nil
+		}
+		a, err := st.Stat(dst)
+		if err != nil {
+			return fmt.Errorf("verify: %s: %w", dst, err)
+		}
+		if a.Size != d.n {
+			return fmt.Errorf("verify: %s: has %d bytes, sent %d", dst, a.Size, d.n)
+		}
+		checked = append(checked, "size")
+		if a.ETag != "" && !a.Opaque {
+			etag := strings.Trim(a.ETag, `"`)
+			n := 0
+			if i := strings.LastIndex(etag, "-"); i >= 0 {
+				n, _ = strconv.Atoi(etag[i+1:])
+			}
+			want, ok := d.etag(partsof(w), n)
+			if !ok {
+				return fmt.Errorf("verify: %s: etag %s has %d parts, which does not match the part size", dst, etag, n)
+			}
+			if etag != want {
+				return fmt.Errorf("verify: %s: etag mismatch: have %s sent %s", dst, etag, want)
+			}
+			checked = append(checked, "etag")
+		}
+		if a.MD5 != nil {
+			if !bytes.Equal(a.MD5, d.md5.Sum(nil)) {
+				return fmt.Errorf("verify: %s: md5 mismatch: have %x sent %x", dst, a.MD5, d.md5.Sum(nil))
+			}
+			checked = append(checked, "md5")
+		}
+		if a.CRC32C != nil {
+			if *a.CRC32C != d.crc.Sum32() {
+				return fmt.Errorf("verify: %s: crc32c mismatch: have %08x sent %08x", dst, *a.CRC32C, d.crc.Sum32())
+			}
+			checked = append(checked, "crc32c")
+		}
+	}
+	line.Add("checked", strings.Join(checked, ","), "sha256", d.sha256()).Printf("verified")
+	if *storesum {
+		return storeSum(dst, d.sha256())
+	}
+	return nil
+}
+
+// storeSum records the sha256 of a verified copy as metadata
+func storeSum(dst, sum string) error {
+	type S interface {
+		SetMeta(file string, meta map[string]string) error
+	}
+	s, ok := driver[uri(dst).Scheme].(S)
+	if !ok {
+		log.Warn.Add("dst", dst).Printf("verify: scheme does not store metadata")
+		return nil
+	}
+	if err := s.SetMeta(dst, map[string]string{"sha256": sum}); err != nil {
+		return fmt.Errorf("verify: store sha256: %s: %w", dst, err)
+	}
+	return nil
+}
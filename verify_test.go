@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type partwriter struct{ ps int64 }
+
+func (p partwriter) Write(b []byte) (int, error) { return len(b), nil }
+func (p partwriter) Partsize() int64             { return p.ps }
+
+func TestDigestETag(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d := newDigest(partwriter{4096}, io.Discard)
+	// odd sized writes cross the part boundaries
+	for p := data; len(p) > 0; {
+		n := 777
+		if n > len(p) {
+			n = len(p)
+		}
+		d.Write(p[:n])
+		p = p[n:]
+	}
+	sum := []byte{}
+	for p := data; len(p) > 0; {
+		n := 4096
+		if n > len(p) {
+			n = len(p)
+		}
+		h := md5.Sum(p[:n])
+		sum = append(sum, h[:]...)
+		p = p[n:]
+	}
+	want := fmt.Sprintf("%x-3", md5.Sum(sum))
+	if have, ok := d.etag(4096, 3); !ok || have != want {
+		t.Fatalf("multipart: have %q %v want %q", have, ok, want)
+	}
+	if have, _ := d.etag(0, 0); have != fmt.Sprintf("%x", md5.Sum(data)) {
+		t.Fatalf("single: have %q", have)
+	}
+	if _, ok := d.etag(4096, 2); ok {
+		t.Fatalf("wrong part count: want !ok")
+	}
+	if _, ok := d.etag(8192, 2); ok {
+		t.Fatalf("unknown part size: want !ok")
+	}
+}
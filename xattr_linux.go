@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// getxattrs returns the user.* extended attributes of file, without
+// the prefix
+func getxattrs(file string) map[string]string {
+	n, err := syscall.Listxattr(file, nil)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	list := make([]byte, n)
+	if n, err = syscall.Listxattr(file, list); err != nil {
+		return nil
+	}
+	attr := map[string]string{}
+	for _, name := range strings.Split(string(list[:n]), "\x00") {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		size, err := syscall.Getxattr(file, name, nil)
+		if err != nil {
+			continue
+		}
+		v := make([]byte, size)
+		if size, err = syscall.Getxattr(file, name, v); err != nil {
+			continue
+		}
+		attr[strings.TrimPrefix(name, "user.")] = string(v[:size])
+	}
+	return attr
+}
+
+// setxattrs sets the attributes as user.* extended attributes of file
+func setxattrs(file string, attr map[string]string) error {
+	for k, v := range attr {
+		if err := syscall.Setxattr(file, "user."+k, []byte(v), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
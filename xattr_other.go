@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getxattrs(file string) map[string]string { return nil }
+
+func setxattrs(file string, attr map[string]string) error { return nil }